@@ -4,6 +4,7 @@ package muse // import "lukechampine.com/muse"
 import (
 	"crypto/ed25519"
 	"encoding/json"
+	"time"
 
 	"go.sia.tech/siad/modules"
 	"go.sia.tech/siad/types"
@@ -12,10 +13,30 @@ import (
 )
 
 // A Contract represents a Sia file contract, along with additional metadata.
+//
+// If the contract was created by renewing another contract, RenewedFrom is the
+// ID of that contract; likewise, if the contract has been renewed, RenewedTo
+// is the ID of the resulting contract.
+//
+// RenterFunds, NewFileSize, and RevisionNumber reflect the latest revision of
+// the contract, which the server periodically fetches from the host; LastSeen
+// is the time at which it was fetched. If the revision has never been fetched,
+// LastSeen is the zero time.
+//
+// If the server could not resolve the host's current address, HostAddress is
+// the last known address of the host, and AddressError describes the failure.
 type Contract struct {
 	renter.Contract
-	HostAddress modules.NetAddress
-	EndHeight   types.BlockHeight
+	HostAddress    modules.NetAddress
+	EndHeight      types.BlockHeight
+	Tenant         string
+	RenewedFrom    types.FileContractID
+	RenewedTo      types.FileContractID
+	RenterFunds    types.Currency
+	NewFileSize    uint64
+	RevisionNumber uint64
+	LastSeen       time.Time
+	AddressError   string `json:",omitempty"`
 }
 
 type responseContracts []Contract
@@ -23,11 +44,19 @@ type responseContracts []Contract
 // MarshalJSON implements json.Marshaler.
 func (r responseContracts) MarshalJSON() ([]byte, error) {
 	enc := make([]struct {
-		HostKey     hostdb.HostPublicKey `json:"hostKey"`
-		ID          types.FileContractID `json:"id"`
-		RenterKey   ed25519.PrivateKey   `json:"renterKey"`
-		HostAddress modules.NetAddress   `json:"hostAddress"`
-		EndHeight   types.BlockHeight    `json:"endHeight"`
+		HostKey        hostdb.HostPublicKey `json:"hostKey"`
+		ID             types.FileContractID `json:"id"`
+		RenterKey      ed25519.PrivateKey   `json:"renterKey,omitempty"`
+		HostAddress    modules.NetAddress   `json:"hostAddress"`
+		EndHeight      types.BlockHeight    `json:"endHeight"`
+		Tenant         string               `json:"tenant,omitempty"`
+		RenewedFrom    types.FileContractID `json:"renewedFrom"`
+		RenewedTo      types.FileContractID `json:"renewedTo"`
+		RenterFunds    types.Currency       `json:"renterFunds"`
+		NewFileSize    uint64               `json:"newFileSize"`
+		RevisionNumber uint64               `json:"revisionNumber"`
+		LastSeen       time.Time            `json:"lastSeen"`
+		AddressError   string               `json:"addressError,omitempty"`
 	}, len(r))
 	for i := range enc {
 		enc[i].HostKey = r[i].HostKey
@@ -35,29 +64,433 @@ func (r responseContracts) MarshalJSON() ([]byte, error) {
 		enc[i].RenterKey = r[i].RenterKey
 		enc[i].HostAddress = r[i].HostAddress
 		enc[i].EndHeight = r[i].EndHeight
+		enc[i].Tenant = r[i].Tenant
+		enc[i].RenewedFrom = r[i].RenewedFrom
+		enc[i].RenewedTo = r[i].RenewedTo
+		enc[i].RenterFunds = r[i].RenterFunds
+		enc[i].NewFileSize = r[i].NewFileSize
+		enc[i].RevisionNumber = r[i].RevisionNumber
+		enc[i].LastSeen = r[i].LastSeen
+		enc[i].AddressError = r[i].AddressError
 	}
 	return json.Marshal(enc)
 }
 
-// RequestForm is the request type for the /form endpoint.
+// ResponseError is the response type for failed requests. Kind is one of the
+// ErrorKind constants, allowing clients to distinguish between errors without
+// inspecting the message.
+type ResponseError struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+// Kinds of errors reported in a ResponseError.
+const (
+	ErrorKindBadRequest        = "badRequest"
+	ErrorKindNotFound          = "notFound"
+	ErrorKindUnauthorized      = "unauthorized"
+	ErrorKindForbidden         = "forbidden"
+	ErrorKindHostRejected      = "hostRejected"
+	ErrorKindInsufficientFunds = "insufficientFunds"
+	ErrorKindInternal          = "internal"
+)
+
+// RequestForm is the request type for the /form endpoint. If Target is
+// non-nil, Funds must be zero, and the server estimates the funds from Target
+// and Settings.
 type RequestForm struct {
 	HostKey     hostdb.HostPublicKey
 	Funds       types.Currency
+	Target      *FundsTarget `json:",omitempty"`
 	StartHeight types.BlockHeight
 	EndHeight   types.BlockHeight
 	Settings    hostdb.HostSettings
 }
 
-// RequestRenew is the request type for the /renew endpoint.
+// RequestRenew is the request type for the /renew endpoint. Target is
+// interpreted as in RequestForm.
 type RequestRenew struct {
 	ID          types.FileContractID
 	Funds       types.Currency
+	Target      *FundsTarget `json:",omitempty"`
 	StartHeight types.BlockHeight
 	EndHeight   types.BlockHeight
 	Settings    hostdb.HostSettings
 }
 
-// RequestScan is the request type for the /scan endpoint.
+// RequestRefresh is the request type for the /refresh endpoint. If Funds is
+// zero, the contract is refreshed with the funds it was formed or renewed
+// with.
+type RequestRefresh struct {
+	ID          types.FileContractID
+	Funds       types.Currency
+	StartHeight types.BlockHeight
+}
+
+// ResponseForm is the response type for the /form and /renew endpoints. If
+// the request specified a Target, Estimate is the breakdown of the estimated
+// funds.
+type ResponseForm struct {
+	Contract
+	Estimate *FundsEstimate `json:",omitempty"`
+}
+
+// A FundsTarget describes the expected usage of a contract, from which the
+// server can estimate the funds required to form or renew it.
+type FundsTarget struct {
+	Storage  uint64 // bytes stored for the duration of the contract
+	Upload   uint64 // bytes uploaded to the host
+	Download uint64 // bytes downloaded from the host
+}
+
+// A FundsEstimate is a breakdown of the estimated cost of a contract. Funds
+// is the sum of the storage and bandwidth costs, and is the value passed to
+// the host as the renter's funds. TotalCost is the amount spent from the
+// wallet: the funds, the host fee, and the siafund fee, but not the
+// transaction fee, which is not known in advance.
+type FundsEstimate struct {
+	StorageCost    types.Currency
+	UploadCost     types.Currency
+	DownloadCost   types.Currency
+	HostFee        types.Currency
+	SiafundFee     types.Currency
+	Funds          types.Currency
+	HostCollateral types.Currency
+	TotalCost      types.Currency
+}
+
+// RequestHostSetForm is the request type for the /hostsets/:name/form
+// endpoint.
+type RequestHostSetForm struct {
+	Funds       types.Currency
+	StartHeight types.BlockHeight
+	EndHeight   types.BlockHeight
+}
+
+// Funds policies for bulk renewals.
+const (
+	FundsFixed = "fixed" // use the supplied Funds
+	FundsSame  = "same"  // use the funds that the previous contract was formed or renewed with
+	FundsUsage = "usage" // extrapolate from the previous contract's spending, using Funds as a minimum
+)
+
+// RequestHostSetRenew is the request type for the /hostsets/:name/renew
+// endpoint. If FundsPolicy is empty, FundsFixed is used.
+type RequestHostSetRenew struct {
+	FundsPolicy string
+	Funds       types.Currency
+	StartHeight types.BlockHeight
+	EndHeight   types.BlockHeight
+}
+
+// A HostResult reports the outcome of forming or renewing a contract with one
+// host as part of a bulk operation. Exactly one of Contract and Error is set.
+type HostResult struct {
+	HostKey  hostdb.HostPublicKey `json:"hostKey"`
+	Contract *Contract            `json:"contract,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// RequestScan is the request type for the /scan endpoint. Unless Force is set,
+// the server may respond with the results of a recent scan.
 type RequestScan struct {
 	HostKey hostdb.HostPublicKey
+	Force   bool
+}
+
+// HostInfo contains the statistics that the server has gathered about a host
+// by periodically scanning it.
+type HostInfo struct {
+	PublicKey       hostdb.HostPublicKey `json:"publicKey"`
+	Settings        hostdb.HostSettings  `json:"settings"`
+	LastScan        time.Time            `json:"lastScan"`
+	LastSuccess     time.Time            `json:"lastSuccess"`
+	LastError       string               `json:"lastError,omitempty"`
+	TotalScans      uint64               `json:"totalScans"`
+	SuccessfulScans uint64               `json:"successfulScans"`
+	LastLatency     time.Duration        `json:"lastLatency"`
+	AverageLatency  time.Duration        `json:"averageLatency"`
+	SettingsHistory []SettingsChange     `json:"settingsHistory"`
+
+	// ConsecutiveFailures is the number of scans that have failed since the
+	// last successful scan.
+	ConsecutiveFailures uint64 `json:"consecutiveFailures"`
+}
+
+// Uptime returns the fraction of scans of the host that succeeded.
+func (hi HostInfo) Uptime() float64 {
+	if hi.TotalScans == 0 {
+		return 0
+	}
+	return float64(hi.SuccessfulScans) / float64(hi.TotalScans)
+}
+
+// RequestRecommend is the request type for the /hosts/recommend endpoint.
+// Hosts are scored on the estimated cost of a contract with the specified
+// Target and Duration. Only hosts with at least Target.Storage bytes of
+// remaining storage and an uptime of at least MinUptime are recommended.
+type RequestRecommend struct {
+	Count      int
+	Target     FundsTarget
+	Duration   types.BlockHeight
+	MinUptime  float64
+	Candidates []hostdb.HostPublicKey
+	Exclude    []hostdb.HostPublicKey
+}
+
+// A HostScore is the score assigned to a host by the /hosts/recommend
+// endpoint. Each component score is between 0 and 1, relative to the other
+// candidates; Score is their product. Cost is the estimated total cost of the
+// requested contract.
+type HostScore struct {
+	HostKey         hostdb.HostPublicKey `json:"hostKey"`
+	Score           float64              `json:"score"`
+	PriceScore      float64              `json:"priceScore"`
+	CollateralScore float64              `json:"collateralScore"`
+	UptimeScore     float64              `json:"uptimeScore"`
+	LatencyScore    float64              `json:"latencyScore"`
+	StorageScore    float64              `json:"storageScore"`
+	Cost            types.Currency       `json:"cost"`
+}
+
+// A SettingsChange records the settings reported by a host when its prices
+// changed.
+type SettingsChange struct {
+	Time     time.Time           `json:"time"`
+	Settings hostdb.HostSettings `json:"settings"`
+}
+
+// A RenewPolicy specifies how the contracts in a host set are automatically
+// renewed. When the end height of a contract is within Window blocks of the
+// current height, the contract is renewed with the specified Funds, and its
+// new end height is set to the current height plus Duration. A policy with a
+// Duration of zero disables automatic renewal.
+//
+// If RefreshThreshold is nonzero, contracts outside the renew window are also
+// refreshed: when the remaining renter funds of a contract's latest revision
+// fall below RefreshThreshold, the contract is renewed with the specified Funds
+// and its existing end height.
+type RenewPolicy struct {
+	Window           types.BlockHeight `json:"window"`
+	Duration         types.BlockHeight `json:"duration"`
+	Funds            types.Currency    `json:"funds"`
+	RefreshThreshold types.Currency    `json:"refreshThreshold"`
+}
+
+// A HealPolicy causes the server to automatically replace failing hosts in a
+// host set. A host is replaced if its MaxFailedScans most recent scans all
+// failed (if MaxFailedScans is nonzero), or if PriceBreach is set and its
+// latest settings violate the server's price limits. The replacement is the
+// best host recommended by /hosts/recommend for Target, Duration, and
+// MinUptime; the server forms a contract with it lasting Duration blocks,
+// using Funds, or funds estimated from Target if Funds is zero. The contract
+// with the replaced host is left untouched, so that its data can be migrated.
+type HealPolicy struct {
+	MaxFailedScans uint64            `json:"maxFailedScans"`
+	PriceBreach    bool              `json:"priceBreach"`
+	Funds          types.Currency    `json:"funds"`
+	Target         FundsTarget       `json:"target"`
+	Duration       types.BlockHeight `json:"duration"`
+	MinUptime      float64           `json:"minUptime"`
+}
+
+// A Budget limits the amount of siacoins that may be spent forming and
+// renewing contracts with the hosts in a host set. Periods begin at multiples
+// of Period; within each period, the total cost of the contracts formed or
+// renewed (as recorded in the ledger) may not exceed Allowance. A budget with
+// a Period of zero imposes no limit.
+type Budget struct {
+	Allowance types.Currency    `json:"allowance"`
+	Period    types.BlockHeight `json:"period"`
+}
+
+// PriceLimits bound the settings of the hosts that the server will form or
+// renew contracts with. MinCollateralRatio is the minimum ratio of the host's
+// collateral to its storage price. Zero values impose no limit.
+type PriceLimits struct {
+	MaxStoragePrice    types.Currency    `json:"maxStoragePrice"`
+	MaxUploadPrice     types.Currency    `json:"maxUploadPrice"`
+	MaxDownloadPrice   types.Currency    `json:"maxDownloadPrice"`
+	MaxContractPrice   types.Currency    `json:"maxContractPrice"`
+	MinCollateralRatio float64           `json:"minCollateralRatio"`
+	MaxWindowSize      types.BlockHeight `json:"maxWindowSize"`
+}
+
+// Host rule actions.
+const (
+	HostRuleBlock = "block"
+	HostRuleAllow = "allow"
+)
+
+// A HostRule blocks or allows contracts with a host, or with every host in a
+// network range. Exactly one of HostKey and Network is set; Network is a CIDR
+// range (e.g. "203.0.113.0/24") that is matched against the IP addresses of
+// the host's announced address, as resolved via shard. Rules created by the
+// administrator have an empty Tenant and apply to every tenant; rules created
+// by a tenant apply only to that tenant.
+type HostRule struct {
+	ID      string               `json:"id"`
+	Action  string               `json:"action"`
+	HostKey hostdb.HostPublicKey `json:"hostKey,omitempty"`
+	Network string               `json:"network,omitempty"`
+	Reason  string               `json:"reason,omitempty"`
+	Tenant  string               `json:"tenant,omitempty"`
+}
+
+// A LedgerEntry records the cost of forming or renewing a contract.
+type LedgerEntry struct {
+	Type       string               `json:"type"` // "form" or "renew"
+	ContractID types.FileContractID `json:"contractID"`
+	HostKey    hostdb.HostPublicKey `json:"hostKey"`
+	Tenant     string               `json:"tenant,omitempty"`
+	Height     types.BlockHeight    `json:"height"` // chain height when recorded
+	Funds      types.Currency       `json:"funds"`
+	HostFee    types.Currency       `json:"hostFee"`
+	SiafundTax types.Currency       `json:"siafundTax"`
+	TxnFee     types.Currency       `json:"txnFee"`
+}
+
+// Total returns the total cost of the entry.
+func (e LedgerEntry) Total() types.Currency {
+	return e.Funds.Add(e.HostFee).Add(e.SiafundTax).Add(e.TxnFee)
+}
+
+// A ContractQuery filters, sorts, and paginates the contracts returned by the
+// /contracts endpoint. Zero values match all contracts, except MaxEndHeight,
+// which, if zero, matches all end heights. If Sort is empty, contracts are
+// returned in the order they were formed, unless Limit or Cursor is set, in
+// which case they are sorted by ID.
+type ContractQuery struct {
+	HostSet      string
+	Archived     bool
+	HostKey      hostdb.HostPublicKey
+	Status       string // "active", "expired", or "" for both
+	MinEndHeight types.BlockHeight
+	MaxEndHeight types.BlockHeight
+	IDPrefix     string
+	Sort         string // "id" or "endHeight"; prefix with "-" to reverse
+	Limit        int    // if zero, all matching contracts are returned
+	Cursor       string // from a previous query with the same parameters
+}
+
+// A LedgerQuery filters the entries returned by the /ledger endpoint. Zero
+// values match all entries, except MaxHeight, which, if zero, matches all
+// heights.
+type LedgerQuery struct {
+	HostKey   hostdb.HostPublicKey
+	HostSet   string
+	Tenant    string
+	MinHeight types.BlockHeight
+	MaxHeight types.BlockHeight
+}
+
+// An AuditEntry records a state-changing API call. Before and After contain
+// the state of the affected object (contract, host set, renew policy, or
+// budget) before and after the call; they are empty if the object did not
+// exist. Renter keys are never recorded.
+type AuditEntry struct {
+	Seq        uint64          `json:"seq"`
+	Time       time.Time       `json:"time"`
+	Caller     string          `json:"caller"` // "admin", "tenant:<name>", "autorenew", or "autoheal"
+	RemoteAddr string          `json:"remoteAddr,omitempty"`
+	RequestID  string          `json:"requestID,omitempty"`
+	Route      string          `json:"route"`
+	Action     string          `json:"action"` // "form", "renew", "delete", "archive", "restore", "hostset", "renewpolicy", "budget", "pricelimits", "healpolicy", "hostrule", or "webhook"
+	Target     string          `json:"target"` // contract ID, host set name, webhook ID, or host rule ID
+	Tenant     string          `json:"tenant,omitempty"`
+	Summary    string          `json:"summary"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// An AuditQuery filters the entries returned by the /audit endpoint. Zero
+// values match all entries. Entries are returned oldest first, unless Reverse
+// is set, in which case the most recent entries are returned, newest first.
+type AuditQuery struct {
+	Action  string
+	Target  string
+	After   uint64 // only return entries with a greater Seq
+	Before  uint64 // only return entries with a lesser Seq
+	Limit   int
+	Reverse bool
+}
+
+// ResponseTenantKey is the response type for the /tenants/:name endpoint.
+type ResponseTenantKey struct {
+	Key string `json:"key"`
+}
+
+// Event types.
+const (
+	EventForm         = "form"         // a contract was formed
+	EventRenew        = "renew"        // a contract was renewed
+	EventDelete       = "delete"       // a contract was archived, either manually or after expiring
+	EventRestore      = "restore"      // a contract was restored from the archive
+	EventHostSet      = "hostset"      // a host set was created, modified, or deleted
+	EventExpiring     = "expiring"     // a contract that has not been renewed is about to expire
+	EventRenewFailed  = "renewfailed"  // a contract could not be renewed automatically
+	EventHostOffline  = "hostoffline"  // a host that was previously reachable failed a scan
+	EventHostReplaced = "hostreplaced" // a failing host was replaced in a host set
+)
+
+// A Webhook is an HTTP endpoint that the server notifies of events. Each event
+// is POSTed to the URL as a JSON-encoded Event, signed with the
+// webhook's Secret (see WebhookSignature). If Events is empty, the webhook
+// receives every event; otherwise, it only receives the listed event types.
+//
+// Webhooks created by a tenant only receive events concerning that tenant's
+// contracts and host sets.
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // only returned when the webhook is created
+	Events []string `json:"events,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+}
+
+// An Event describes a change on the server, as delivered to webhooks and
+// /events subscribers. Contract is set for contract events, with its renter
+// key omitted; for renewals, it is the new contract. HostSet is set for
+// EventHostSet, and Error is set for EventRenewFailed and EventHostOffline.
+// For EventHostReplaced, HostKey is the replaced host, HostSet is its set,
+// Contract is the contract formed with the replacement, and Error describes
+// why the host was replaced.
+type Event struct {
+	ID       string               `json:"id"`
+	Type     string               `json:"type"`
+	Time     time.Time            `json:"time"`
+	HostKey  hostdb.HostPublicKey `json:"hostKey,omitempty"`
+	HostSet  string               `json:"hostSet,omitempty"`
+	Tenant   string               `json:"tenant,omitempty"`
+	Contract *Contract            `json:"contract,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plainEvent Event
+	enc := struct {
+		plainEvent
+		Contract json.RawMessage `json:"contract,omitempty"`
+	}{plainEvent: plainEvent(e)}
+	if e.Contract != nil {
+		c := *e.Contract
+		c.RenterKey = nil
+		js, err := json.Marshal(responseContracts{c})
+		if err != nil {
+			return nil, err
+		}
+		enc.Contract = js[1 : len(js)-1] // strip array brackets
+	}
+	return json.Marshal(enc)
+}
+
+// A WebhookDelivery records an attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	EventID    string    `json:"eventID"`
+	EventType  string    `json:"eventType"`
+	Time       time.Time `json:"time"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
 }
@@ -0,0 +1,130 @@
+package muse
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.sia.tech/siad/types"
+)
+
+const (
+	// archiveInterval is how often the server archives expired contracts.
+	archiveInterval = time.Hour
+
+	// archiveDelay is the number of blocks after a contract's end height
+	// before it is automatically archived. It exceeds the proof window of
+	// any reasonable host, so the host's storage proof (if any) will have
+	// been submitted by the time the contract is archived.
+	archiveDelay = 1008
+)
+
+// archiveContract moves the contract at index i of s.contracts into the
+// archive, recording ae in the audit log. The caller must hold s.mu.
+func (s *server) archiveContract(i int, ae AuditEntry) error {
+	c := s.contracts[i]
+	err := s.store.Update(func(tx Tx) error {
+		if err := s.putAudit(tx, ae); err != nil {
+			return err
+		} else if err := s.putArchivedContract(tx, c); err != nil {
+			return err
+		}
+		return tx.Delete(bucketContracts, c.ID[:])
+	})
+	if err != nil {
+		return err
+	}
+	s.contracts = append(s.contracts[:i], s.contracts[i+1:]...)
+	s.archive = append(s.archive, c)
+	return nil
+}
+
+func (s *server) archiveLoop() {
+	t := time.NewTicker(archiveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		height, err := s.shard.ChainHeight()
+		if err != nil {
+			s.log.Warn("could not determine chain height for archival", "err", err)
+			continue
+		}
+		s.archiveExpired(height)
+	}
+}
+
+// archiveExpired archives each contract whose end height is more than
+// archiveDelay blocks in the past.
+func (s *server) archiveExpired(height types.BlockHeight) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(s.contracts); {
+		c := s.contracts[i]
+		if c.EndHeight+archiveDelay >= height {
+			i++
+			continue
+		}
+		ae := AuditEntry{
+			Caller:  "autoarchive",
+			Route:   "autoarchive",
+			Action:  "archive",
+			Target:  c.ID.String(),
+			Tenant:  c.Tenant,
+			Summary: "archived expired contract with host " + string(c.HostKey),
+			Before:  auditState(newAuditContract(c)),
+		}
+		if err := s.archiveContract(i, ae); err != nil {
+			s.log.Warn("could not archive contract", "contractID", c.ID, "hostKey", c.HostKey, "err", err)
+			return
+		}
+		s.log.Info("archived expired contract", "contractID", c.ID, "hostKey", c.HostKey, "endHeight", c.EndHeight, "height", height)
+		s.notifyContract(EventDelete, c, nil)
+	}
+}
+
+func (s *server) handleRestore(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	idStr := strings.TrimPrefix(req.URL.Path, "/restore/")
+	if strings.Contains(idStr, "/") {
+		writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	var id types.FileContractID
+	if err := id.LoadString(idStr); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.archive {
+		if c.ID != id || !canAccess(req, c.Tenant) {
+			continue
+		}
+		ae := newAuditEntry(req, "restore", id.String(), c.Tenant, "restored contract with host "+string(c.HostKey), nil, newAuditContract(c))
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			} else if err := s.putContract(tx, c); err != nil {
+				return err
+			}
+			return tx.Delete(bucketArchive, id[:])
+		})
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.archive = append(s.archive[:i], s.archive[i+1:]...)
+		s.contracts = append(s.contracts, c)
+		s.reqLog(req).Info("restored contract", "contractID", id)
+		s.notifyContract(EventRestore, c, nil)
+		return
+	}
+	writeErrorKind(w, "No record of that contract in the archive", http.StatusBadRequest, ErrorKindNotFound)
+}
@@ -0,0 +1,178 @@
+package muse
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// maxAuditEntries is the maximum number of entries returned by a single
+// /audit request.
+const maxAuditEntries = 1000
+
+// auditContract is the representation of a contract in the audit log. It
+// omits the renter key, since the audit log is not encrypted.
+type auditContract struct {
+	ID          types.FileContractID `json:"id"`
+	HostKey     hostdb.HostPublicKey `json:"hostKey"`
+	EndHeight   types.BlockHeight    `json:"endHeight"`
+	Tenant      string               `json:"tenant,omitempty"`
+	RenewedFrom types.FileContractID `json:"renewedFrom"`
+}
+
+func newAuditContract(c Contract) auditContract {
+	return auditContract{
+		ID:          c.ID,
+		HostKey:     c.HostKey,
+		EndHeight:   c.EndHeight,
+		Tenant:      c.Tenant,
+		RenewedFrom: c.RenewedFrom,
+	}
+}
+
+// auditState encodes v for inclusion in an audit entry. A nil v is encoded as
+// an empty value.
+func auditState(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	js, _ := json.Marshal(v)
+	return js
+}
+
+// requestCaller identifies the caller that made the request.
+func requestCaller(req *http.Request) string {
+	if t := requestTenant(req); t != "" {
+		return "tenant:" + t
+	}
+	return "admin"
+}
+
+// newAuditEntry returns an audit entry for the request.
+func newAuditEntry(req *http.Request, action, target, tenant, summary string, before, after interface{}) AuditEntry {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return AuditEntry{
+		Time:       time.Now(),
+		Caller:     requestCaller(req),
+		RemoteAddr: req.RemoteAddr,
+		RequestID:  id,
+		Route:      req.Method + " " + req.URL.Path,
+		Action:     action,
+		Target:     target,
+		Tenant:     tenant,
+		Summary:    summary,
+		Before:     auditState(before),
+		After:      auditState(after),
+	}
+}
+
+// putAudit appends e to the audit log. The sequence number is derived from the
+// transaction itself, so no server state changes if the transaction is rolled
+// back.
+func (s *server) putAudit(tx Tx, e AuditEntry) error {
+	e.Seq = lastAuditSeq(tx) + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, e.Seq)
+	return putJSON(tx, bucketAudit, key, e)
+}
+
+// lastAuditSeq returns the sequence number of the most recent audit entry.
+func lastAuditSeq(tx Tx) uint64 {
+	var seq uint64
+	tx.Seek(bucketAudit, nil, true, func(key, _ []byte) (bool, error) {
+		if len(key) != 8 {
+			return true, nil
+		}
+		seq = binary.BigEndian.Uint64(key)
+		return false, nil
+	})
+	return seq
+}
+
+func (s *server) handleAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	parseSeq := func(name string) (uint64, bool) {
+		v := req.FormValue(name)
+		if v == "" {
+			return 0, true
+		}
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Invalid %v: %v", name, err), http.StatusBadRequest)
+			return 0, false
+		}
+		return seq, true
+	}
+	after, ok := parseSeq("after")
+	if !ok {
+		return
+	}
+	before, ok := parseSeq("before")
+	if !ok {
+		return
+	}
+	reverse := req.FormValue("reverse") == "true"
+	limit := maxAuditEntries
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		} else if n < limit {
+			limit = n
+		}
+	}
+	action := req.FormValue("action")
+	target := req.FormValue("target")
+
+	// seek directly to the first entry in range, rather than scanning the
+	// whole log
+	var start []byte
+	if reverse && before > 0 {
+		start = make([]byte, 8)
+		binary.BigEndian.PutUint64(start, before-1)
+	} else if !reverse && after < math.MaxUint64 {
+		start = make([]byte, 8)
+		binary.BigEndian.PutUint64(start, after+1)
+	}
+	var entries []AuditEntry
+	err := s.store.View(func(tx Tx) error {
+		return tx.Seek(bucketAudit, start, reverse, func(key, value []byte) (bool, error) {
+			if len(key) != 8 {
+				return true, nil
+			}
+			seq := binary.BigEndian.Uint64(key)
+			if seq <= after || (before > 0 && seq >= before) {
+				return false, nil
+			}
+			var e AuditEntry
+			if err := json.Unmarshal(value, &e); err != nil {
+				return false, err
+			}
+			if (action == "" || e.Action == action) &&
+				(target == "" || e.Target == target) &&
+				canAccess(req, e.Tenant) {
+				entries = append(entries, e)
+			}
+			return len(entries) < limit, nil
+		})
+	})
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
@@ -0,0 +1,175 @@
+package muse
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.sia.tech/siad/crypto"
+	"lukechampine.com/frand"
+)
+
+// A ServerOption modifies the default configuration of a server.
+type ServerOption func(*server)
+
+// WithAdminKey enables authentication. Every API request (including those
+// proxied to shard) must supply either the admin key or a tenant key issued
+// via the /tenants endpoints as a bearer token. Requests made with the admin
+// key can access all contracts and host sets; requests made with a tenant key
+// can only access the contracts and host sets belonging to that tenant.
+//
+// If no admin key is supplied, authentication is disabled, and every request
+// is treated as though it were made with the admin key.
+func WithAdminKey(key string) ServerOption {
+	return func(s *server) {
+		s.adminKey = key
+	}
+}
+
+type tenantKey struct{}
+
+// requestTenant returns the tenant that made the request. The empty string
+// denotes the administrator.
+func requestTenant(req *http.Request) string {
+	t, _ := req.Context().Value(tenantKey{}).(string)
+	return t
+}
+
+// canAccess reports whether the tenant that made the request may access an
+// object owned by the specified tenant.
+func canAccess(req *http.Request, owner string) bool {
+	t := requestTenant(req)
+	return t == "" || t == owner
+}
+
+// authenticate returns the tenant associated with the request's bearer token.
+func (s *server) authenticate(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	var key string
+	if strings.HasPrefix(auth, prefix) {
+		key = strings.TrimPrefix(auth, prefix)
+	} else if _, password, ok := req.BasicAuth(); ok {
+		// shard clients cannot set headers, so they pass the key as the
+		// password of the server URL instead
+		key = password
+	} else {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) == 1 {
+		return "", true
+	}
+	h := crypto.HashBytes([]byte(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, keyHash := range s.tenants {
+		if keyHash == h {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (s *server) handleTenants(w http.ResponseWriter, req *http.Request) {
+	if requestTenant(req) != "" {
+		writeError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/tenants/")
+	if strings.Contains(name, "/") {
+		writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if name != "" {
+			writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s.mu.Lock()
+		names := make([]string, 0, len(s.tenants))
+		for name := range s.tenants {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		writeJSON(w, names)
+
+	case http.MethodPost:
+		if name == "" {
+			writeError(w, "No tenant name provided", http.StatusBadRequest)
+			return
+		}
+		key := hex.EncodeToString(frand.Bytes(32))
+		h := crypto.HashBytes([]byte(key))
+		s.mu.Lock()
+		summary := "created tenant " + name
+		if _, ok := s.tenants[name]; ok {
+			summary = "replaced key of tenant " + name
+		}
+		ae := newAuditEntry(req, "tenant", name, name, summary, nil, nil)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			return tx.Put(bucketTenants, []byte(name), h[:])
+		})
+		if err == nil {
+			s.tenants[name] = h
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ResponseTenantKey{Key: key})
+
+	case http.MethodDelete:
+		if name == "" {
+			writeError(w, "No tenant name provided", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		_, exists := s.tenants[name]
+		ae := newAuditEntry(req, "tenant", name, name, "deleted tenant "+name, nil, nil)
+		err := s.store.Update(func(tx Tx) error {
+			if exists {
+				if err := s.putAudit(tx, ae); err != nil {
+					return err
+				}
+			}
+			return tx.Delete(bucketTenants, []byte(name))
+		})
+		if err == nil {
+			delete(s.tenants, name)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = withRequestID(w, req)
+	s.reqLog(req).Debug("handling request", "method", req.Method, "path", req.URL.Path)
+	if s.adminKey != "" {
+		tenant, ok := s.authenticate(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="muse"`)
+			writeError(w, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), tenantKey{}, tenant))
+	}
+	s.mux.ServeHTTP(w, req)
+}
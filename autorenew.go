@@ -0,0 +1,167 @@
+package muse
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.sia.tech/siad/types"
+)
+
+// autoRenewInterval is how often the server checks whether any contracts
+// need to be renewed.
+const autoRenewInterval = 10 * time.Minute
+
+func (s *server) handleRenewPolicy(w http.ResponseWriter, req *http.Request, setName string) {
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		_, ok := s.hostSets[setName]
+		ok = ok && canAccess(req, s.hostSetOwners[setName])
+		policy := s.renewPolicies[setName]
+		s.mu.Unlock()
+		if !ok {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		writeJSON(w, policy)
+
+	case http.MethodPut:
+		var policy RenewPolicy
+		if err := json.NewDecoder(req.Body).Decode(&policy); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if policy.Duration != 0 && policy.Duration <= policy.Window {
+			writeError(w, "Duration must be greater than renew window", http.StatusBadRequest)
+			return
+		}
+		if !policy.RefreshThreshold.IsZero() && policy.Funds.Cmp(policy.RefreshThreshold) <= 0 {
+			writeError(w, "Funds must be greater than refresh threshold", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		if _, ok := s.hostSets[setName]; !ok || !canAccess(req, s.hostSetOwners[setName]) {
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		var before, after interface{}
+		if old, ok := s.renewPolicies[setName]; ok {
+			before = old
+		}
+		if policy.Duration != 0 {
+			after = policy
+		}
+		ae := newAuditEntry(req, "renewpolicy", setName, s.hostSetOwners[setName], "set renew policy of host set "+setName, before, after)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			if policy.Duration == 0 {
+				return tx.Delete(bucketRenewPolicies, []byte(setName))
+			}
+			return putJSON(tx, bucketRenewPolicies, []byte(setName), policy)
+		})
+		if err == nil {
+			s.renewPolicies[setName] = policy
+			if policy.Duration == 0 {
+				delete(s.renewPolicies, setName)
+			}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) autoRenewLoop() {
+	t := time.NewTicker(autoRenewInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		height, err := s.shard.ChainHeight()
+		if err != nil {
+			s.log.Warn("could not determine chain height for auto-renewal", "err", err)
+			continue
+		}
+		s.autoRenew(height)
+		s.autoRefresh(height)
+		s.notifyExpiring(height)
+	}
+}
+
+// autoRenew renews each contract that falls within the renew window of its
+// host set's policy.
+func (s *server) autoRenew(height types.BlockHeight) {
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+
+	type renewal struct {
+		contract Contract
+		policy   RenewPolicy
+	}
+	var renewals []renewal
+	s.mu.Lock()
+	setNames := make([]string, 0, len(s.renewPolicies))
+	for name := range s.renewPolicies {
+		setNames = append(setNames, name)
+	}
+	sort.Strings(setNames)
+	// a host may appear in multiple sets; the first policy (by set name) wins
+	seen := make(map[types.FileContractID]bool)
+	for _, name := range setNames {
+		policy := s.renewPolicies[name]
+		contracts, _ := s.activeContracts(name)
+		for _, c := range contracts {
+			// expired contracts can no longer be renewed
+			if !seen[c.ID] && isActive(c, height) && c.EndHeight <= height+policy.Window {
+				seen[c.ID] = true
+				renewals = append(renewals, renewal{c, policy})
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, r := range renewals {
+		log := s.log.With("autoRenew", true)
+		if _, err := s.autoRenewContract(log, "autorenew", r.contract, r.policy.Funds, height, height+r.policy.Duration); err != nil {
+			s.metrics.inc(&s.metrics.autoRenewFailures)
+			s.log.Warn("could not auto-renew contract", "contractID", r.contract.ID, "hostKey", r.contract.HostKey, "height", height, "err", err)
+			s.notifyRenewFailed(r.contract, err)
+		}
+	}
+}
+
+// autoRenewContract scans the host of old and, if the host passes the server's
+// rules, price limits, and budgets, renews old with the specified funds and
+// heights. The renewal is recorded in the audit log under caller.
+func (s *server) autoRenewContract(log *Logger, caller string, old Contract, funds types.Currency, start, end types.BlockHeight) (Contract, error) {
+	if err := s.checkHostRules(old.Tenant, old.HostKey); err != nil {
+		return Contract{}, err
+	}
+	host, err := s.scanHost(old.HostKey)
+	if err != nil {
+		return Contract{}, err
+	}
+	if err := s.checkPrices(old.Tenant, host); err != nil {
+		return Contract{}, err
+	}
+	release, err := s.reserveBudget(old.Tenant, host, &old, funds, start, end)
+	if err != nil {
+		return Contract{}, err
+	}
+	defer release()
+	ae := AuditEntry{Caller: caller, Route: caller, Action: "renew"}
+	return s.renewContract(log, ae, old, host, funds, start, end)
+}
@@ -0,0 +1,239 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// bulkConcurrency is the maximum number of hosts processed in parallel by the
+// bulk form and renew endpoints. Formations and renewals still acquire utxoMu,
+// so only scanning and host communication happen concurrently.
+const bulkConcurrency = 8
+
+// forEachHost calls fn on each host using a bounded pool of workers, returning
+// the results in the same order as hostKeys.
+func forEachHost(hostKeys []hostdb.HostPublicKey, fn func(hostdb.HostPublicKey) HostResult) []HostResult {
+	results := make([]HostResult, len(hostKeys))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bulkConcurrency)
+	for i, hostKey := range hostKeys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, hostKey hostdb.HostPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = fn(hostKey)
+		}(i, hostKey)
+	}
+	wg.Wait()
+	return results
+}
+
+func (s *server) handleHostSetForm(w http.ResponseWriter, req *http.Request, setName string) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var rf RequestHostSetForm
+	if err := json.NewDecoder(req.Body).Decode(&rf); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rf.EndHeight <= rf.StartHeight {
+		writeError(w, "End height must be greater than start height", http.StatusBadRequest)
+		return
+	}
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		writeError(w, "Could not determine chain height: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// form contracts with every host that lacks an active contract
+	s.mu.Lock()
+	set, ok := s.hostSets[setName]
+	owner := s.hostSetOwners[setName]
+	ok = ok && canAccess(req, owner)
+	contracts, _ := s.activeContracts(setName)
+	s.mu.Unlock()
+	if !ok {
+		writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	}
+	active := make(map[hostdb.HostPublicKey]bool)
+	for _, c := range contracts {
+		if isActive(c, height) {
+			active[c.HostKey] = true
+		}
+	}
+	var hostKeys []hostdb.HostPublicKey
+	for _, hostKey := range set {
+		if !active[hostKey] {
+			hostKeys = append(hostKeys, hostKey)
+		}
+	}
+
+	log := s.reqLog(req).With("hostSet", setName)
+	results := forEachHost(hostKeys, func(hostKey hostdb.HostPublicKey) HostResult {
+		r := HostResult{HostKey: hostKey}
+		err := s.checkHostRules(owner, hostKey)
+		var host hostdb.ScannedHost
+		if err == nil {
+			host, err = s.scanHost(hostKey)
+		}
+		if err == nil {
+			err = s.checkPrices(owner, host)
+		}
+		var release func()
+		if err == nil {
+			release, err = s.reserveBudget(owner, host, nil, rf.Funds, rf.StartHeight, rf.EndHeight)
+		}
+		if err == nil {
+			defer release()
+		}
+		if err == nil {
+			ae := newAuditEntry(req, "form", "", "", "", nil, nil)
+			var c Contract
+			if c, err = s.formContract(log, ae, owner, host, rf.Funds, rf.StartHeight, rf.EndHeight); err == nil {
+				r.Contract = &c
+			}
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		return r
+	})
+	writeJSON(w, results)
+}
+
+// renewalFunds returns the funds to renew c with between the specified
+// heights, according to policy. The caller must hold s.mu.
+func (s *server) renewalFunds(c Contract, policy string, funds types.Currency, start, end types.BlockHeight) (types.Currency, error) {
+	if policy == FundsFixed || policy == "" {
+		return funds, nil
+	}
+	var prev LedgerEntry
+	var ok bool
+	for _, e := range s.ledger {
+		if e.ContractID == c.ID {
+			prev, ok = e, true
+			break
+		}
+	}
+	if !ok {
+		return types.ZeroCurrency, errors.New("no ledger entry for previous contract")
+	}
+	if policy == FundsSame {
+		return prev.Funds, nil
+	}
+
+	// extrapolate the rate at which the previous contract's funds were spent
+	if c.LastSeen.IsZero() {
+		return types.ZeroCurrency, errors.New("latest revision of previous contract is unknown")
+	}
+	spent := types.ZeroCurrency
+	if prev.Funds.Cmp(c.RenterFunds) > 0 {
+		spent = prev.Funds.Sub(c.RenterFunds)
+	}
+	elapsed := start
+	if elapsed > c.EndHeight {
+		elapsed = c.EndHeight
+	}
+	if elapsed <= prev.Height {
+		return funds, nil
+	}
+	elapsed -= prev.Height
+	est := spent.Mul64(uint64(end - start)).Div64(uint64(elapsed))
+	if est.Cmp(funds) < 0 {
+		est = funds
+	}
+	return est, nil
+}
+
+func (s *server) handleHostSetRenew(w http.ResponseWriter, req *http.Request, setName string) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var rr RequestHostSetRenew
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch rr.FundsPolicy {
+	case "", FundsFixed, FundsSame, FundsUsage:
+	default:
+		writeError(w, fmt.Sprintf("Unknown funds policy %q", rr.FundsPolicy), http.StatusBadRequest)
+		return
+	}
+	if rr.EndHeight <= rr.StartHeight {
+		writeError(w, "End height must be greater than start height", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	set, ok := s.hostSets[setName]
+	owner := s.hostSetOwners[setName]
+	ok = ok && canAccess(req, owner)
+	contracts, _ := s.activeContracts(setName)
+	s.mu.Unlock()
+	if !ok {
+		writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	}
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+	latest := make(map[hostdb.HostPublicKey]Contract, len(contracts))
+	for _, c := range contracts {
+		latest[c.HostKey] = c
+	}
+
+	log := s.reqLog(req).With("hostSet", setName)
+	results := forEachHost(set, func(hostKey hostdb.HostPublicKey) HostResult {
+		r := HostResult{HostKey: hostKey}
+		old, ok := latest[hostKey]
+		if !ok {
+			r.Error = "no contract to renew"
+			return r
+		}
+		err := s.checkHostRules(owner, hostKey)
+		var host hostdb.ScannedHost
+		if err == nil {
+			host, err = s.scanHost(hostKey)
+		}
+		if err == nil {
+			err = s.checkPrices(owner, host)
+		}
+		var funds types.Currency
+		if err == nil {
+			s.mu.Lock()
+			funds, err = s.renewalFunds(old, rr.FundsPolicy, rr.Funds, rr.StartHeight, rr.EndHeight)
+			s.mu.Unlock()
+		}
+		var release func()
+		if err == nil {
+			release, err = s.reserveBudget(owner, host, &old, funds, rr.StartHeight, rr.EndHeight)
+		}
+		if err == nil {
+			defer release()
+		}
+		if err == nil {
+			ae := newAuditEntry(req, "renew", "", "", "", nil, nil)
+			var c Contract
+			if c, err = s.renewContract(log, ae, old, host, funds, rr.StartHeight, rr.EndHeight); err == nil {
+				r.Contract = &c
+			}
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		return r
+	})
+	writeJSON(w, results)
+}
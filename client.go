@@ -1,6 +1,7 @@
 package muse
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -8,10 +9,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.sia.tech/siad/types"
 	"lukechampine.com/shard"
@@ -20,51 +24,230 @@ import (
 
 // A Client communicates with a muse server.
 type Client struct {
-	addr string
-	ctx  context.Context
+	addr    string
+	key     string
+	ctx     context.Context
+	hc      *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// The retry parameters of a Client returned by NewClient.
+const (
+	defaultRetries = 3
+	defaultBackoff = 250 * time.Millisecond
+)
+
+// An APIError is an error returned by a muse server. Errors of the kinds
+// below are returned as their own types, each of which wraps an APIError;
+// other errors are returned as an *APIError.
+type APIError struct {
+	StatusCode int
+	Kind       string
+	Message    string
+}
+
+// Error implements error.
+func (e *APIError) Error() string { return e.Message }
+
+// A NotFoundError indicates that the requested object, e.g. a contract or host
+// set, does not exist (or belongs to another tenant).
+type NotFoundError struct{ APIError }
+
+// Unwrap returns the underlying APIError.
+func (e *NotFoundError) Unwrap() error { return &e.APIError }
+
+// A BadRequestError indicates that the request was invalid.
+type BadRequestError struct{ APIError }
+
+// Unwrap returns the underlying APIError.
+func (e *BadRequestError) Unwrap() error { return &e.APIError }
+
+// An UnauthorizedError indicates that the request's API key was missing or
+// invalid.
+type UnauthorizedError struct{ APIError }
+
+// Unwrap returns the underlying APIError.
+func (e *UnauthorizedError) Unwrap() error { return &e.APIError }
+
+// A HostRejectedError indicates that a host rejected a contract formation or
+// renewal.
+type HostRejectedError struct{ APIError }
+
+// Unwrap returns the underlying APIError.
+func (e *HostRejectedError) Unwrap() error { return &e.APIError }
+
+// An InsufficientFundsError indicates that the server's wallet could not fund
+// a contract formation or renewal.
+type InsufficientFundsError struct{ APIError }
+
+// Unwrap returns the underlying APIError.
+func (e *InsufficientFundsError) Unwrap() error { return &e.APIError }
+
+// decodeError converts an error response into an error of the corresponding
+// type.
+func decodeError(r *http.Response) error {
+	body, _ := ioutil.ReadAll(r.Body)
+	var re ResponseError
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || json.Unmarshal(body, &re) != nil || re.Error == "" {
+		// not a muse error, e.g. one generated by a proxy
+		re = ResponseError{Error: strings.TrimSpace(string(body))}
+	}
+	if re.Error == "" {
+		re.Error = http.StatusText(r.StatusCode)
+	}
+	if re.Kind == "" {
+		re.Kind = statusErrorKind(r.StatusCode)
+	}
+	e := APIError{StatusCode: r.StatusCode, Kind: re.Kind, Message: re.Error}
+	switch e.Kind {
+	case ErrorKindNotFound:
+		return &NotFoundError{e}
+	case ErrorKindBadRequest:
+		return &BadRequestError{e}
+	case ErrorKindUnauthorized:
+		return &UnauthorizedError{e}
+	case ErrorKindHostRejected:
+		return &HostRejectedError{e}
+	case ErrorKindInsufficientFunds:
+		return &InsufficientFundsError{e}
+	}
+	return &e
+}
+
+// isTransient reports whether a failed request may succeed if retried. GET
+// requests are retried after any network error or a 502, 503, or 504
+// response; other requests are retried only if the server could not be
+// reached, since otherwise they may have taken effect.
+func isTransient(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return method == http.MethodGet
+		}
+		return false
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false // e.g. a malformed response
+	}
+	var opErr *net.OpError
+	return method == http.MethodGet || (errors.As(err, &opErr) && opErr.Op == "dial")
 }
 
 func (c *Client) req(method string, route string, data, resp interface{}) error {
-	var body io.Reader
+	_, err := c.do(method, route, data, resp)
+	return err
+}
+
+// do is like req, but also returns the response headers. Transient failures
+// are retried with exponential backoff.
+func (c *Client) do(method string, route string, data, resp interface{}) (http.Header, error) {
+	var js []byte
 	if data != nil {
-		js, _ := json.Marshal(data)
+		var err error
+		if js, err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		h, err := c.doOnce(method, route, js, resp)
+		if err == nil || attempt >= c.retries || !isTransient(c.ctx, method, err) {
+			return h, err
+		}
+		select {
+		case <-time.After(c.backoff << uint(attempt)):
+		case <-c.ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) doOnce(method string, route string, js []byte, resp interface{}) (http.Header, error) {
+	var body io.Reader
+	if js != nil {
 		body = bytes.NewReader(js)
 	}
 	req, err := http.NewRequestWithContext(c.ctx, method, fmt.Sprintf("%v%v", c.addr, route), body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	r, err := http.DefaultClient.Do(req)
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	r, err := c.hc.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer r.Body.Close()
 	defer io.Copy(ioutil.Discard, r.Body)
 	if r.StatusCode != 200 {
-		err, _ := ioutil.ReadAll(r.Body)
-		return errors.New(strings.TrimSpace(string(err)))
+		return nil, decodeError(r)
 	}
 	if resp == nil {
-		return nil
+		return r.Header, nil
 	}
-	return json.NewDecoder(r.Body).Decode(resp)
+	return r.Header, json.NewDecoder(r.Body).Decode(resp)
 }
 
 func (c *Client) get(route string, r interface{}) error     { return c.req("GET", route, nil, r) }
 func (c *Client) post(route string, d, r interface{}) error { return c.req("POST", route, d, r) }
 func (c *Client) put(route string, d, r interface{}) error  { return c.req("PUT", route, d, r) }
+func (c *Client) delete(route string) error                 { return c.req("DELETE", route, nil, nil) }
 
 // WithContext returns a new Client whose requests are subject to the supplied
 // context.
 func (c *Client) WithContext(ctx context.Context) *Client {
-	return &Client{
-		addr: c.addr,
-		ctx:  ctx,
-	}
+	cc := *c
+	cc.ctx = ctx
+	return &cc
 }
 
-// AllContracts returns all contracts formed by the server.
+// WithAPIKey returns a new Client that authenticates its requests with the
+// supplied key, which may be either the server's admin key or a tenant key.
+func (c *Client) WithAPIKey(key string) *Client {
+	cc := *c
+	cc.key = key
+	return &cc
+}
+
+// WithHTTPClient returns a new Client that sends its requests using hc, e.g.
+// to use a custom transport. By default, http.DefaultClient is used.
+func (c *Client) WithHTTPClient(hc *http.Client) *Client {
+	cc := *c
+	cc.hc = hc
+	return &cc
+}
+
+// WithTimeout returns a new Client whose requests time out after d. Each
+// retry of a request is subject to its own timeout. A timeout of zero means
+// no timeout. The timeout does not apply to Watch.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	hc := *c.hc
+	hc.Timeout = d
+	return c.WithHTTPClient(&hc)
+}
+
+// WithRetries returns a new Client that retries transient failures up to n
+// times, waiting backoff before the first retry and doubling the wait before
+// each subsequent retry. GET requests are retried after any network error or
+// a 502, 503, or 504 response; other requests are retried only if the server
+// could not be reached. By default, requests are retried 3 times, starting
+// with a 250ms backoff. If n is zero, requests are not retried.
+func (c *Client) WithRetries(n int, backoff time.Duration) *Client {
+	cc := *c
+	cc.retries = n
+	cc.backoff = backoff
+	return &cc
+}
+
+// AllContracts returns all contracts formed by the server. To filter, sort, or
+// paginate the contracts, use QueryContracts.
 func (c *Client) AllContracts() (cs []Contract, err error) {
 	err = c.get("/contracts", &cs)
 	return
@@ -79,7 +262,51 @@ func (c *Client) Contracts(set string) (cs []Contract, err error) {
 	return
 }
 
-// Scan queries the specified host for its current settings.
+// QueryContracts returns the contracts matching the query. If q.Limit is
+// non-zero, at most q.Limit contracts are returned, along with a cursor that
+// can be set as q.Cursor to retrieve the next page; the cursor is empty if no
+// contracts remain.
+func (c *Client) QueryContracts(q ContractQuery) (cs []Contract, next string, err error) {
+	v := make(url.Values)
+	if q.HostSet != "" {
+		v.Set("hostset", q.HostSet)
+	}
+	if q.Archived {
+		v.Set("archived", "true")
+	}
+	if q.HostKey != "" {
+		v.Set("host", string(q.HostKey))
+	}
+	if q.Status != "" {
+		v.Set("status", q.Status)
+	}
+	if q.MinEndHeight != 0 {
+		v.Set("minEndHeight", strconv.FormatUint(uint64(q.MinEndHeight), 10))
+	}
+	if q.MaxEndHeight != 0 {
+		v.Set("maxEndHeight", strconv.FormatUint(uint64(q.MaxEndHeight), 10))
+	}
+	if q.IDPrefix != "" {
+		v.Set("idPrefix", q.IDPrefix)
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	h, err := c.do("GET", "/contracts?"+v.Encode(), nil, &cs)
+	if err != nil {
+		return nil, "", err
+	}
+	return cs, h.Get("X-Next-Cursor"), nil
+}
+
+// Scan queries the specified host for its current settings. If the server has
+// scanned the host recently, it may return the results of that scan instead.
 //
 // Note that the host may also be scanned via the hostdb.Scan function.
 func (c *Client) Scan(host hostdb.HostPublicKey) (settings hostdb.HostSettings, err error) {
@@ -89,6 +316,39 @@ func (c *Client) Scan(host hostdb.HostPublicKey) (settings hostdb.HostSettings,
 	return
 }
 
+// ForceScan is like Scan, but always causes the server to scan the host.
+func (c *Client) ForceScan(host hostdb.HostPublicKey) (settings hostdb.HostSettings, err error) {
+	err = c.post("/scan", RequestScan{
+		HostKey: host,
+		Force:   true,
+	}, &settings)
+	return
+}
+
+// Hosts returns the statistics the server has gathered about each host it has
+// scanned.
+func (c *Client) Hosts() (hosts []HostInfo, err error) {
+	err = c.get("/hosts/", &hosts)
+	return
+}
+
+// HostInfo returns the statistics the server has gathered about the specified
+// host.
+func (c *Client) HostInfo(host hostdb.HostPublicKey) (info HostInfo, err error) {
+	err = c.get("/hosts/"+string(host), &info)
+	return
+}
+
+// RecommendHosts scores the candidate hosts and returns the best ones, in
+// descending order of score. The candidates are the hosts that the server has
+// previously scanned, plus any in req.Candidates, less any in req.Exclude.
+// Fewer than req.Count hosts are returned if too few satisfy the request's
+// constraints.
+func (c *Client) RecommendHosts(req RequestRecommend) (scores []HostScore, err error) {
+	err = c.post("/hosts/recommend", req, &scores)
+	return
+}
+
 // Form forms a contract with a host. The settings should be obtained from a
 // recent call to Scan. If the settings have changed in the interim, the host
 // may reject the contract.
@@ -103,6 +363,55 @@ func (c *Client) Form(host hostdb.HostPublicKey, funds types.Currency, start, en
 	return
 }
 
+// FormTarget forms a contract with a host, like Form, but rather than
+// specifying the contract's funds directly, the server estimates them from the
+// supplied target and settings. The breakdown of the estimate is returned
+// along with the contract.
+func (c *Client) FormTarget(host hostdb.HostPublicKey, target FundsTarget, start, end types.BlockHeight, settings hostdb.HostSettings) (Contract, FundsEstimate, error) {
+	var resp ResponseForm
+	err := c.post("/form", RequestForm{
+		HostKey:     host,
+		Target:      &target,
+		StartHeight: start,
+		EndHeight:   end,
+		Settings:    settings,
+	}, &resp)
+	if err != nil {
+		return Contract{}, FundsEstimate{}, err
+	} else if resp.Estimate == nil {
+		return Contract{}, FundsEstimate{}, errors.New("server did not return a funds estimate")
+	}
+	return resp.Contract, *resp.Estimate, nil
+}
+
+// FormHostSet forms a contract with each host in the named set that lacks an
+// active contract, scanning each host first. The returned results report the
+// outcome for each such host; a failure with one host does not prevent
+// contracts from being formed with the others.
+func (c *Client) FormHostSet(set string, funds types.Currency, start, end types.BlockHeight) (results []HostResult, err error) {
+	err = c.post("/hostsets/"+set+"/form", RequestHostSetForm{
+		Funds:       funds,
+		StartHeight: start,
+		EndHeight:   end,
+	}, &results)
+	return
+}
+
+// RenewHostSet renews the latest contract with each host in the named set,
+// rescanning each host first. The funds for each renewal are determined by
+// the policy, which is one of FundsFixed, FundsSame, or FundsUsage. The
+// returned results report the outcome for each host; a failure with one host
+// does not prevent the others from being renewed.
+func (c *Client) RenewHostSet(set string, policy string, funds types.Currency, start, end types.BlockHeight) (results []HostResult, err error) {
+	err = c.post("/hostsets/"+set+"/renew", RequestHostSetRenew{
+		FundsPolicy: policy,
+		Funds:       funds,
+		StartHeight: start,
+		EndHeight:   end,
+	}, &results)
+	return
+}
+
 // Renew renews the contract with the specified ID, which must refer to a
 // contract previously formed by the server. The settings should be obtained
 // from a recent call to Scan. If the settings have changed in the interim, the
@@ -118,14 +427,69 @@ func (c *Client) Renew(id types.FileContractID, funds types.Currency, start, end
 	return
 }
 
-// Delete removes the record of a contract from the server. The contract itself
-// is not revised or otherwise affected in any way. In general, this method
-// should only be used on contracts that have expired and are no longer needed.
+// RenewTarget renews a contract, like Renew, but rather than specifying the
+// contract's funds directly, the server estimates them from the supplied
+// target and settings. The breakdown of the estimate is returned along with
+// the contract.
+func (c *Client) RenewTarget(id types.FileContractID, target FundsTarget, start, end types.BlockHeight, settings hostdb.HostSettings) (Contract, FundsEstimate, error) {
+	var resp ResponseForm
+	err := c.post("/renew", RequestRenew{
+		ID:          id,
+		Target:      &target,
+		StartHeight: start,
+		EndHeight:   end,
+		Settings:    settings,
+	}, &resp)
+	if err != nil {
+		return Contract{}, FundsEstimate{}, err
+	} else if resp.Estimate == nil {
+		return Contract{}, FundsEstimate{}, errors.New("server did not return a funds estimate")
+	}
+	return resp.Contract, *resp.Estimate, nil
+}
+
+// Refresh renews the contract with the specified ID, keeping its end height,
+// so that a contract which has run low on funds can continue to be used. If
+// funds is zero, the contract is refreshed with the funds it was formed or
+// renewed with.
+func (c *Client) Refresh(id types.FileContractID, funds types.Currency, start types.BlockHeight) (contract Contract, err error) {
+	err = c.post("/refresh", RequestRefresh{
+		ID:          id,
+		Funds:       funds,
+		StartHeight: start,
+	}, &contract)
+	return
+}
+
+// Delete moves a contract into the server's archive. The contract itself is
+// not revised or otherwise affected in any way. In general, this method should
+// only be used on contracts that have expired and are no longer needed.
+// Archived contracts can be restored with Restore.
 func (c *Client) Delete(id types.FileContractID) (err error) {
 	err = c.post("/delete/"+id.String(), nil, nil)
 	return
 }
 
+// ArchivedContracts returns all of the contracts in the server's archive.
+func (c *Client) ArchivedContracts() (cs []Contract, err error) {
+	err = c.get("/contracts?archived=true", &cs)
+	return
+}
+
+// Restore moves a contract out of the server's archive.
+func (c *Client) Restore(id types.FileContractID) (err error) {
+	err = c.post("/restore/"+id.String(), nil, nil)
+	return
+}
+
+// Lineage returns every contract in the renewal chain containing the contract
+// with the specified ID, ordered from the original contract to its latest
+// renewal.
+func (c *Client) Lineage(id types.FileContractID) (cs []Contract, err error) {
+	err = c.get("/lineage/"+id.String(), &cs)
+	return
+}
+
 // HostSets returns the current list of host sets.
 func (c *Client) HostSets() (hs []string, err error) {
 	err = c.get("/hostsets/", &hs)
@@ -145,20 +509,272 @@ func (c *Client) SetHostSet(name string, hosts []hostdb.HostPublicKey) (err erro
 	return
 }
 
-// SHARD returns a client for the muse server's shard endpoints.
+// RenewPolicy returns the renew policy of the named host set.
+func (c *Client) RenewPolicy(set string) (policy RenewPolicy, err error) {
+	err = c.get("/hostsets/"+set+"/renewpolicy", &policy)
+	return
+}
+
+// SetRenewPolicy sets the renew policy of the named host set. The server will
+// automatically renew the set's contracts according to the policy. If the
+// policy has a Duration of zero, automatic renewal is disabled.
+func (c *Client) SetRenewPolicy(set string, policy RenewPolicy) (err error) {
+	err = c.put("/hostsets/"+set+"/renewpolicy", policy, nil)
+	return
+}
+
+// HealPolicy returns the heal policy of the named host set.
+func (c *Client) HealPolicy(set string) (policy HealPolicy, err error) {
+	err = c.get("/hostsets/"+set+"/healpolicy", &policy)
+	return
+}
+
+// SetHealPolicy sets the heal policy of the named host set. The server will
+// periodically replace failing hosts in the set according to the policy. If
+// the policy has a MaxFailedScans of zero and PriceBreach is unset, the set's
+// heal policy is removed.
+func (c *Client) SetHealPolicy(set string, policy HealPolicy) (err error) {
+	err = c.put("/hostsets/"+set+"/healpolicy", policy, nil)
+	return
+}
+
+// Budget returns the budget of the named host set.
+func (c *Client) Budget(set string) (budget Budget, err error) {
+	err = c.get("/hostsets/"+set+"/budget", &budget)
+	return
+}
+
+// SetBudget sets the budget of the named host set. The server will reject
+// requests to form or renew contracts with hosts in the set if doing so would
+// exceed the budget. If the budget has a Period of zero, the set's budget is
+// removed.
+func (c *Client) SetBudget(set string, budget Budget) (err error) {
+	err = c.put("/hostsets/"+set+"/budget", budget, nil)
+	return
+}
+
+// PriceLimits returns the price limit overrides of the named host set.
+func (c *Client) PriceLimits(set string) (limits PriceLimits, err error) {
+	err = c.get("/hostsets/"+set+"/pricelimits", &limits)
+	return
+}
+
+// SetPriceLimits sets the price limit overrides of the named host set. Each
+// nonzero limit overrides the corresponding server-wide limit for the hosts in
+// the set. If every limit is zero, the set's overrides are removed.
+func (c *Client) SetPriceLimits(set string, limits PriceLimits) (err error) {
+	err = c.put("/hostsets/"+set+"/pricelimits", limits, nil)
+	return
+}
+
+// HostRules returns the host rules that apply to the caller: the server-wide
+// rules, and, if the caller is a tenant, the tenant's own rules. The
+// administrator sees every rule.
+func (c *Client) HostRules() (rules []HostRule, err error) {
+	err = c.get("/hostrules/", &rules)
+	return
+}
+
+// AddHostRule adds a host rule, returning it with its ID filled in. Rules
+// added by the administrator apply server-wide; rules added by a tenant apply
+// only to that tenant.
+func (c *Client) AddHostRule(rule HostRule) (r HostRule, err error) {
+	err = c.post("/hostrules/", rule, &r)
+	return
+}
+
+// BlockHost adds a rule blocking contracts with the specified host.
+func (c *Client) BlockHost(hostKey hostdb.HostPublicKey, reason string) (HostRule, error) {
+	return c.AddHostRule(HostRule{Action: HostRuleBlock, HostKey: hostKey, Reason: reason})
+}
+
+// DeleteHostRule deletes the host rule with the specified ID.
+func (c *Client) DeleteHostRule(id string) (err error) {
+	err = c.delete("/hostrules/" + id)
+	return
+}
+
+// Ledger returns the ledger entries matching the query, ordered by height.
+func (c *Client) Ledger(q LedgerQuery) (entries []LedgerEntry, err error) {
+	v := make(url.Values)
+	if q.HostKey != "" {
+		v.Set("host", string(q.HostKey))
+	}
+	if q.HostSet != "" {
+		v.Set("hostset", q.HostSet)
+	}
+	if q.Tenant != "" {
+		v.Set("tenant", q.Tenant)
+	}
+	if q.MinHeight != 0 {
+		v.Set("min", strconv.FormatUint(uint64(q.MinHeight), 10))
+	}
+	if q.MaxHeight != 0 {
+		v.Set("max", strconv.FormatUint(uint64(q.MaxHeight), 10))
+	}
+	err = c.get("/ledger?"+v.Encode(), &entries)
+	return
+}
+
+// Audit returns the audit log entries matching the query, oldest first, or
+// newest first if q.Reverse is set. The server returns at most 1000 entries
+// per call; use q.After (or q.Before, with q.Reverse) to page through the log.
+func (c *Client) Audit(q AuditQuery) (entries []AuditEntry, err error) {
+	v := make(url.Values)
+	if q.Action != "" {
+		v.Set("action", q.Action)
+	}
+	if q.Target != "" {
+		v.Set("target", q.Target)
+	}
+	if q.After != 0 {
+		v.Set("after", strconv.FormatUint(q.After, 10))
+	}
+	if q.Before != 0 {
+		v.Set("before", strconv.FormatUint(q.Before, 10))
+	}
+	if q.Reverse {
+		v.Set("reverse", "true")
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	err = c.get("/audit?"+v.Encode(), &entries)
+	return
+}
+
+// Webhooks returns the webhooks registered with the server. Their secrets are
+// omitted.
+func (c *Client) Webhooks() (hooks []Webhook, err error) {
+	err = c.get("/webhooks/", &hooks)
+	return
+}
+
+// AddWebhook registers a webhook with the server. The URL and Events fields
+// of h are used; if h.Secret is empty, the server generates one. The returned
+// webhook includes its ID and secret.
+func (c *Client) AddWebhook(h Webhook) (hook Webhook, err error) {
+	err = c.post("/webhooks/", h, &hook)
+	return
+}
+
+// DeleteWebhook removes the webhook with the specified ID.
+func (c *Client) DeleteWebhook(id string) (err error) {
+	err = c.delete("/webhooks/" + id)
+	return
+}
+
+// WebhookDeliveries returns the most recent delivery attempts of the webhook
+// with the specified ID, oldest first.
+func (c *Client) WebhookDeliveries(id string) (deliveries []WebhookDelivery, err error) {
+	err = c.get("/webhooks/"+id+"/deliveries", &deliveries)
+	return
+}
+
+// Watch subscribes to the server's event stream. If types are specified, only
+// events of those types are sent. The returned channel is closed when ctx is
+// cancelled or the stream ends, e.g. because the server restarted or because
+// the client fell too far behind; since events may have been missed, callers
+// should then re-fetch any state they depend on before calling Watch again.
+func (c *Client) Watch(ctx context.Context, types ...string) (<-chan Event, error) {
+	route := "/events"
+	if len(types) > 0 {
+		route += "?events=" + url.QueryEscape(strings.Join(types, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%v%v", c.addr, route), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	// the stream is long-lived, so it must not be subject to a timeout
+	hc := *c.hc
+	hc.Timeout = 0
+	r, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		defer r.Body.Close()
+		return nil, decodeError(r)
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer r.Body.Close()
+		s := bufio.NewScanner(r.Body)
+		s.Buffer(nil, 1<<20)
+		var data []byte
+		for s.Scan() {
+			line := s.Text()
+			if strings.HasPrefix(line, "data: ") {
+				data = append(data, strings.TrimPrefix(line, "data: ")...)
+			} else if line == "" && len(data) > 0 {
+				var ev Event
+				err := json.Unmarshal(data, &ev)
+				data = data[:0]
+				if err != nil {
+					continue
+				}
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Tenants returns the names of all tenants. It requires the admin key.
+func (c *Client) Tenants() (tenants []string, err error) {
+	err = c.get("/tenants/", &tenants)
+	return
+}
+
+// CreateTenant issues a new API key for the named tenant, creating the tenant
+// if it does not exist. Any key previously issued to the tenant is revoked. It
+// requires the admin key.
+func (c *Client) CreateTenant(name string) (key string, err error) {
+	var resp ResponseTenantKey
+	err = c.post("/tenants/"+name, nil, &resp)
+	return resp.Key, err
+}
+
+// DeleteTenant revokes the API key of the named tenant. The tenant's
+// contracts and host sets are not affected. It requires the admin key.
+func (c *Client) DeleteTenant(name string) (err error) {
+	err = c.delete("/tenants/" + name)
+	return
+}
+
+// SHARD returns a client for the muse server's shard endpoints. If the client
+// has an API key, it is passed to the server as the password of the URL.
 func (c *Client) SHARD() *shard.Client {
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		panic(err)
 	}
 	u.Path = path.Join(u.Path, "shard")
+	if c.key != "" {
+		u.User = url.UserPassword("", c.key)
+	}
 	return shard.NewClient(u.String())
 }
 
 // NewClient returns a client that communicates with a muse server listening
 // on the specified address.
 func NewClient(addr string) *Client {
-	return &Client{addr, context.Background()}
+	return &Client{
+		addr:    addr,
+		ctx:     context.Background(),
+		hc:      http.DefaultClient,
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
 }
 
 func modifyURL(str string, fn func(*url.URL)) string {
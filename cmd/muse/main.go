@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -15,7 +17,10 @@ import (
 	"go.sia.tech/siad/modules/consensus"
 	"go.sia.tech/siad/modules/gateway"
 	"go.sia.tech/siad/modules/transactionpool"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/term"
+	"lukechampine.com/frand"
 	"lukechampine.com/muse"
 	"lukechampine.com/shard"
 	"lukechampine.com/us/wallet"
@@ -48,6 +53,87 @@ func getSeed() wallet.Seed {
 	return seed
 }
 
+func getPassphrase() string {
+	passphrase := os.Getenv("MUSE_PASSPHRASE")
+	if passphrase != "" {
+		fmt.Println("Using MUSE_PASSPHRASE environment variable")
+		return passphrase
+	}
+	fmt.Print("Passphrase: ")
+	pw, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatal("Could not read passphrase:", err)
+	}
+	fmt.Println()
+	if len(pw) == 0 {
+		log.Fatal("Passphrase must not be empty")
+	}
+	return string(pw)
+}
+
+// encryptionKey derives the key used to encrypt contracts at rest. If a
+// passphrase is supplied, the key is derived from the passphrase and a random
+// salt stored in dir; otherwise, it is derived from the wallet seed. The salt
+// cannot be recreated, so if it is lost, so are the contracts.
+func encryptionKey(dir string, seed wallet.Seed, passphrase string) ([32]byte, error) {
+	if passphrase == "" {
+		siadSeed := seed.SiadSeed()
+		return blake2b.Sum256(append([]byte("muse contract encryption key"), siadSeed[:]...)), nil
+	}
+	saltPath := filepath.Join(dir, "passphrase.salt")
+	salt, err := ioutil.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = frand.Bytes(32)
+		if err = ioutil.WriteFile(saltPath, salt, 0660); err == nil {
+			log.Printf("Created %v; back it up, as contracts cannot be decrypted without it", saltPath)
+		}
+	}
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var key [32]byte
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32))
+	return key, nil
+}
+
+func readPriceLimits(path string) (muse.PriceLimits, error) {
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return muse.PriceLimits{}, err
+	}
+	var limits muse.PriceLimits
+	if err := json.Unmarshal(js, &limits); err != nil {
+		return muse.PriceLimits{}, err
+	}
+	return limits, nil
+}
+
+func newLogger(format, level string) (*muse.Logger, error) {
+	var f muse.LogFormat
+	switch format {
+	case "logfmt":
+		f = muse.LogfmtFormat
+	case "json":
+		f = muse.JSONFormat
+	default:
+		return nil, fmt.Errorf("unknown log format %q (must be logfmt or json)", format)
+	}
+	var l muse.LogLevel
+	switch level {
+	case "debug":
+		l = muse.LevelDebug
+	case "info":
+		l = muse.LevelInfo
+	case "warn":
+		l = muse.LevelWarn
+	case "error":
+		l = muse.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q (must be debug, info, warn, or error)", level)
+	}
+	return muse.NewLogger(os.Stderr, f, l), nil
+}
+
 func main() {
 	log.SetFlags(0)
 	apiAddr := flag.String("a", ":9580", "host:port that the API server listens on")
@@ -56,6 +142,10 @@ func main() {
 	shardAddr := flag.String("s", "localhost:9480", "host:port of the shard server")
 	serveShard := flag.Bool("serve-shard", false, "run a shard server (on the addr given by -s)")
 	dir := flag.String("d", ".", "directory where server state is stored")
+	usePassphrase := flag.Bool("passphrase", false, "encrypt contracts with a passphrase instead of the wallet seed (the key also depends on passphrase.salt in the -d directory; if that file is lost, the contracts cannot be recovered)")
+	logFormat := flag.String("log-format", "logfmt", "format of server log output (logfmt or json)")
+	logLevel := flag.String("log-level", "info", "minimum level of server log output (debug, info, warn, or error)")
+	priceLimits := flag.String("price-limits", "", "JSON file containing server-wide price limits")
 	flag.Parse()
 
 	if len(flag.Args()) == 1 && flag.Arg(0) == "version" {
@@ -66,6 +156,10 @@ func main() {
 		flag.Usage()
 		return
 	}
+	logger, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *serveWalrus {
 		if err := createWalletServer(*walrusAddr, *dir); err != nil {
@@ -92,8 +186,30 @@ func main() {
 		}
 	}
 
+	seed := getSeed()
+	var passphrase string
+	if *usePassphrase {
+		passphrase = getPassphrase()
+	}
+	key, err := encryptionKey(*dir, seed, passphrase)
+	if err != nil {
+		log.Fatalln("Could not derive encryption key:", err)
+	}
+	opts := []muse.ServerOption{muse.WithEncryptionKey(key), muse.WithLogger(logger)}
+	if *priceLimits != "" {
+		limits, err := readPriceLimits(*priceLimits)
+		if err != nil {
+			log.Fatalln("Could not read price limits:", err)
+		}
+		opts = append(opts, muse.WithPriceLimits(limits))
+	}
+	if adminKey := os.Getenv("MUSE_ADMIN_KEY"); adminKey != "" {
+		log.Println("Using MUSE_ADMIN_KEY environment variable; API authentication is enabled")
+		opts = append(opts, muse.WithAdminKey(adminKey))
+	}
+
 	wc := walrus.NewClient(*walrusAddr)
-	srv, err := muse.NewServer(*dir, wc.ProtoWallet(getSeed()), wc.ProtoTransactionPool(), *shardAddr)
+	srv, err := muse.NewServer(*dir, wc.ProtoWallet(seed), wc.ProtoTransactionPool(), *shardAddr, opts...)
 	if err != nil {
 		log.Fatalln("Could not initialize server:", err)
 	}
@@ -19,7 +19,7 @@ import (
 )
 
 func form(museAddr, hostPrefix string, funds types.Currency, endStr string) error {
-	mc := muse.NewClient(museAddr)
+	mc := newClient(museAddr)
 	sc := mc.SHARD()
 	start, err := sc.ChainHeight()
 	if err != nil {
@@ -33,7 +33,7 @@ func form(museAddr, hostPrefix string, funds types.Currency, endStr string) erro
 	if err != nil {
 		return err
 	}
-	settings, err := mc.Scan(hostKey)
+	settings, err := mc.ForceScan(hostKey)
 	if err != nil {
 		return err
 	}
@@ -45,8 +45,67 @@ func form(museAddr, hostPrefix string, funds types.Currency, endStr string) erro
 	return nil
 }
 
+func formHostSet(museAddr, hostset string, funds types.Currency, endStr string) error {
+	mc := newClient(museAddr)
+	start, err := mc.SHARD().ChainHeight()
+	if err != nil {
+		return err
+	}
+	end, err := parseEnd(start, endStr)
+	if err != nil {
+		return err
+	}
+	results, err := mc.FormHostSet(hostset, funds, start, end)
+	if err != nil {
+		return err
+	}
+	return printHostResults(results, "formed")
+}
+
+func renewHostSet(museAddr, hostset, policy string, funds types.Currency, endStr string) error {
+	mc := newClient(museAddr)
+	start, err := mc.SHARD().ChainHeight()
+	if err != nil {
+		return err
+	}
+	end, err := parseEnd(start, endStr)
+	if err != nil {
+		return err
+	}
+	results, err := mc.RenewHostSet(hostset, policy, funds, start, end)
+	if err != nil {
+		return err
+	}
+	return printHostResults(results, "renewed to")
+}
+
+// printHostResults prints the outcome of a bulk operation, returning an error
+// if any host failed.
+func printHostResults(results []muse.HostResult, verb string) error {
+	if len(results) == 0 {
+		fmt.Println("Nothing to do.")
+		return nil
+	}
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Host:\tResult:")
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Fprintf(w, "%s\tfailed: %v\n", r.HostKey.ShortKey(), r.Error)
+		} else {
+			fmt.Fprintf(w, "%s\t%v %v\n", r.HostKey.ShortKey(), verb, r.Contract.ID)
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%v of %v hosts failed", failed, len(results))
+	}
+	return nil
+}
+
 func renew(museAddr, id string, funds types.Currency, endStr string) error {
-	mc := muse.NewClient(museAddr)
+	mc := newClient(museAddr)
 	sc := mc.SHARD()
 
 	var fcid types.FileContractID
@@ -63,22 +122,16 @@ func renew(museAddr, id string, funds types.Currency, endStr string) error {
 		return err
 	}
 
-	contracts, err := mc.AllContracts()
+	contracts, _, err := mc.QueryContracts(muse.ContractQuery{
+		IDPrefix: fcid.String(),
+	})
 	if err != nil {
 		return err
-	}
-	var hostKey hostdb.HostPublicKey
-	for _, c := range contracts {
-		if c.ID == fcid {
-			hostKey = c.HostKey
-			break
-		}
-	}
-	if hostKey == "" {
+	} else if len(contracts) == 0 {
 		return errors.New("no record of that contract")
 	}
 
-	settings, err := mc.Scan(hostKey)
+	settings, err := mc.ForceScan(contracts[0].HostKey)
 	if err != nil {
 		return err
 	}
@@ -90,8 +143,26 @@ func renew(museAddr, id string, funds types.Currency, endStr string) error {
 	return nil
 }
 
+func refresh(museAddr, id string, funds types.Currency) error {
+	mc := newClient(museAddr)
+	var fcid types.FileContractID
+	if err := fcid.LoadString(id); err != nil {
+		return err
+	}
+	start, err := mc.SHARD().ChainHeight()
+	if err != nil {
+		return err
+	}
+	rc, err := mc.Refresh(fcid, funds, start)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Refreshed contract:", rc.ID)
+	return nil
+}
+
 func listContracts(museAddr, hostset string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	var contracts []muse.Contract
 	var err error
 	if hostset != "" {
@@ -109,14 +180,82 @@ func listContracts(museAddr, hostset string) error {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	fmt.Fprintln(w, "Host:\tContract ID:\tEnd Height:\tIP Address:")
 	for _, contract := range contracts {
-		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", contract.HostKey.ShortKey(), contract.ID, contract.EndHeight, contract.HostAddress)
+		addr := string(contract.HostAddress)
+		if contract.AddressError != "" {
+			addr += " (stale)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", contract.HostKey.ShortKey(), contract.ID, contract.EndHeight, addr)
+	}
+	w.Flush()
+	return nil
+}
+
+func history(museAddr, target, action string, limit int, verbose bool) error {
+	c := newClient(museAddr)
+	var entries []muse.AuditEntry
+	if limit > 0 {
+		// fetch the most recent entries, then display them oldest first
+		q := muse.AuditQuery{Action: action, Target: target, Reverse: true}
+		for len(entries) < limit {
+			q.Limit = limit - len(entries)
+			page, err := c.Audit(q)
+			if err != nil {
+				return err
+			} else if len(page) == 0 {
+				break
+			}
+			entries = append(entries, page...)
+			q.Before = page[len(page)-1].Seq
+		}
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	} else {
+		q := muse.AuditQuery{Action: action, Target: target}
+		for {
+			page, err := c.Audit(q)
+			if err != nil {
+				return err
+			} else if len(page) == 0 {
+				break
+			}
+			entries = append(entries, page...)
+			q.After = page[len(page)-1].Seq
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Println("No history.")
+		return nil
+	}
+	if verbose {
+		for _, e := range entries {
+			fmt.Printf("#%v  %v  %v\n", e.Seq, e.Time.Format(time.RFC3339), e.Summary)
+			fmt.Printf("  Caller:  %v (%v)\n", e.Caller, e.RemoteAddr)
+			fmt.Printf("  Route:   %v\n", e.Route)
+			if e.RequestID != "" {
+				fmt.Printf("  Request: %v\n", e.RequestID)
+			}
+			if len(e.Before) > 0 {
+				fmt.Printf("  Before:  %s\n", e.Before)
+			}
+			if len(e.After) > 0 {
+				fmt.Printf("  After:   %s\n", e.After)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Seq:\tTime:\tCaller:\tAction:\tSummary:")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e.Seq, e.Time.Format(time.RFC3339), e.Caller, e.Action, e.Summary)
 	}
 	w.Flush()
 	return nil
 }
 
 func listHosts(museAddr string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sets, err := c.HostSets()
 	if err != nil {
 		return err
@@ -143,7 +282,7 @@ func listHosts(museAddr string) error {
 }
 
 func createHostSet(museAddr string, setName string, hostPrefixes []string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
 	hosts := make([]hostdb.HostPublicKey, len(hostPrefixes))
 	for i := range hosts {
@@ -162,7 +301,7 @@ func createHostSet(museAddr string, setName string, hostPrefixes []string) error
 }
 
 func deleteHostSet(museAddr string, setName string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	err := c.SetHostSet(setName, nil)
 	if err != nil {
 		return err
@@ -172,7 +311,7 @@ func deleteHostSet(museAddr string, setName string) error {
 }
 
 func addHost(museAddr string, setName string, host string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	hostKey, err := c.SHARD().LookupHost(host)
 	if err != nil {
 		return err
@@ -197,7 +336,7 @@ func addHost(museAddr string, setName string, host string) error {
 }
 
 func removeHost(museAddr string, setName string, host string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	hostKey, err := c.SHARD().LookupHost(host)
 	if err != nil {
 		return err
@@ -221,8 +360,108 @@ func removeHost(museAddr string, setName string, host string) error {
 	return nil
 }
 
-func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeight) error {
-	c := muse.NewClient(museAddr)
+func recommendHosts(museAddr string, n int, storage uint64, duration int, minUptime float64, setName string) error {
+	c := newClient(museAddr)
+	scores, err := c.RecommendHosts(muse.RequestRecommend{
+		Count: n,
+		Target: muse.FundsTarget{
+			Storage:  storage,
+			Upload:   storage,
+			Download: storage,
+		},
+		Duration:  types.BlockHeight(duration),
+		MinUptime: minUptime,
+	})
+	if err != nil {
+		return err
+	} else if len(scores) == 0 {
+		return errors.New("no hosts satisfy the constraints")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Host:\tScore:\tCost:\tPrice:\tCollateral:\tUptime:\tLatency:\tStorage:")
+	for _, hs := range scores {
+		fmt.Fprintf(w, "%v\t%.3f\t%v\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\n", hs.HostKey.ShortKey(), hs.Score,
+			currencyUnits(hs.Cost), hs.PriceScore, hs.CollateralScore, hs.UptimeScore, hs.LatencyScore, hs.StorageScore)
+	}
+	w.Flush()
+	if len(scores) < n {
+		fmt.Printf("Warning: only %v of %v requested hosts satisfy the constraints\n", len(scores), n)
+	}
+
+	if setName != "" {
+		hostKeys := make([]hostdb.HostPublicKey, len(scores))
+		for i := range scores {
+			hostKeys[i] = scores[i].HostKey
+		}
+		if err := c.SetHostSet(setName, hostKeys); err != nil {
+			return err
+		}
+		fmt.Printf("Created host set %q\n", setName)
+	}
+	return nil
+}
+
+func listHostRules(museAddr string) error {
+	rules, err := newClient(museAddr).HostRules()
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Println("No host rules.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID:	Action:	Host:	Tenant:	Reason:")
+	for _, r := range rules {
+		target := r.Network
+		if r.HostKey != "" {
+			target = r.HostKey.ShortKey()
+		}
+		tenant := r.Tenant
+		if tenant == "" {
+			tenant = "(all)"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", r.ID, r.Action, target, tenant, r.Reason)
+	}
+	return w.Flush()
+}
+
+func addHostRule(museAddr string, target string, allow bool, reason string) error {
+	c := newClient(museAddr)
+	rule := muse.HostRule{
+		Action: muse.HostRuleBlock,
+		Reason: reason,
+	}
+	if allow {
+		rule.Action = muse.HostRuleAllow
+	}
+	if strings.Contains(target, "/") {
+		rule.Network = target
+	} else {
+		hostKey, err := c.SHARD().LookupHost(target)
+		if err != nil {
+			return err
+		}
+		rule.HostKey = hostKey
+	}
+	rule, err := c.AddHostRule(rule)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %v rule %v\n", rule.Action, rule.ID)
+	return nil
+}
+
+func removeHostRule(museAddr string, id string) error {
+	if err := newClient(museAddr).DeleteHostRule(id); err != nil {
+		return err
+	}
+	fmt.Printf("Removed host rule %v\n", id)
+	return nil
+}
+
+func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeight, force bool) error {
+	c := newClient(museAddr)
 	sc := c.SHARD()
 
 	currentHeight, err := sc.ChainHeight()
@@ -233,7 +472,11 @@ func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeig
 	if err != nil {
 		return errors.Wrap(err, "could not lookup host")
 	}
-	host, err := c.Scan(hostKey)
+	scanFn := c.Scan
+	if force {
+		scanFn = c.ForceScan
+	}
+	host, err := scanFn(hostKey)
 	if err != nil {
 		return errors.Wrap(err, "could not scan host")
 	}
@@ -244,18 +487,16 @@ func scan(museAddr, hostKeyPrefix string, bytes uint64, duration types.BlockHeig
 		fmt.Printf("Warning: host reports only %v of remaining storage\n", filesizeUnits(int64(host.RemainingStorage)))
 	}
 
-	storageCost := host.StoragePrice.Mul64(bytes).Mul64(uint64(duration))
-	uploadCost := host.UploadBandwidthPrice.Mul64(bytes)
-	downloadCost := host.DownloadBandwidthPrice.Mul64(bytes)
-	hostFee := host.ContractPrice
-	renterFunds := storageCost.Add(uploadCost).Add(downloadCost).Add(hostFee)
-	hostCollateral := host.Collateral.Mul64(bytes).Mul64(uint64(duration))
-	if hostCollateral.Cmp(host.MaxCollateral) > 0 {
-		hostCollateral = host.MaxCollateral
-	}
+	e := muse.EstimateFunds(host, muse.FundsTarget{
+		Storage:  bytes,
+		Upload:   bytes,
+		Download: bytes,
+	}, currentHeight, duration)
+	storageCost, uploadCost, downloadCost := e.StorageCost, e.UploadCost, e.DownloadCost
+	hostFee, siafundFee := e.HostFee, e.SiafundFee
+	renterFunds, hostCollateral := e.Funds, e.HostCollateral
 	totalInputs := renterFunds.Add(hostCollateral)
-	siafundFee := types.Tax(currentHeight, totalInputs)
-	costToRenter := renterFunds.Add(siafundFee)
+	costToRenter := e.TotalCost
 
 	bar := func(c, max types.Currency) string {
 		pct, _ := c.Mul64(500).Div(max).Uint64()
@@ -308,37 +549,44 @@ Transaction Cost: %8v (this is the amount that will be deducted from your wallet
 }
 
 func info(museAddr string, id string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
-	contracts, err := c.AllContracts()
+	contracts, _, err := c.QueryContracts(muse.ContractQuery{
+		IDPrefix: id,
+		Limit:    1,
+	})
 	if err != nil {
 		return err
-	}
-	var contract muse.Contract
-	for _, contract = range contracts {
-		if strings.HasPrefix(contract.ID.String(), id) {
-			break
-		}
-	}
-	if len(contract.RenterKey) == 0 {
+	} else if len(contracts) == 0 {
 		return errors.New("contract not found")
 	}
+	contract := contracts[0]
 	currentHeight, err := sc.ChainHeight()
 	if err != nil {
 		return err
 	}
 
+	// use the revision recorded by the server, if possible; otherwise, ask the
+	// host directly
 	funds, sectors, revErr := func() (string, string, error) {
-		sess, err := proto.NewSession(contract.HostAddress, contract.HostKey, contract.ID, contract.RenterKey, currentHeight)
-		if err != nil {
-			return "?", "?", err
+		renterFunds, fileSize := contract.RenterFunds, contract.NewFileSize
+		if contract.LastSeen.IsZero() {
+			sess, err := proto.NewSession(contract.HostAddress, contract.HostKey, contract.ID, contract.RenterKey, currentHeight)
+			if err != nil {
+				return "?", "?", err
+			}
+			defer sess.Close()
+			rev := sess.Revision()
+			renterFunds, fileSize = rev.RenterFunds(), rev.Revision.NewFileSize
 		}
-		rev := sess.Revision()
-		funds := fmt.Sprintf("%v remaining", currencyUnits(rev.RenterFunds()))
-		sectors := fmt.Sprintf("%v (%v)", rev.Revision.NewFileSize/renterhost.SectorSize,
-			filesizeUnits(int64(rev.Revision.NewFileSize)))
-		return funds, sectors, sess.Close()
+		funds := fmt.Sprintf("%v remaining", currencyUnits(renterFunds))
+		sectors := fmt.Sprintf("%v (%v)", fileSize/renterhost.SectorSize, filesizeUnits(int64(fileSize)))
+		return funds, sectors, nil
 	}()
+	lastSeen := "never"
+	if !contract.LastSeen.IsZero() {
+		lastSeen = contract.LastSeen.Format(time.RFC1123)
+	}
 
 	var remaining string
 	if currentHeight <= contract.EndHeight {
@@ -353,7 +601,8 @@ Contract ID:  %v
 End Height:   %v %v
 Renter Funds: %v
 Sectors:      %v
-`, contract.HostKey.Key(), contract.HostAddress, contract.ID, contract.EndHeight, remaining, funds, sectors)
+Last Seen:    %v
+`, contract.HostKey.Key(), contract.HostAddress, contract.ID, contract.EndHeight, remaining, funds, sectors, lastSeen)
 
 	if revErr != nil {
 		fmt.Println("\nSome values could not be determined because the host returned an error:\n ", revErr)
@@ -363,21 +612,18 @@ Sectors:      %v
 }
 
 func checkup(museAddr string, id string) error {
-	c := muse.NewClient(museAddr)
+	c := newClient(museAddr)
 	sc := c.SHARD()
-	contracts, err := c.AllContracts()
+	contracts, _, err := c.QueryContracts(muse.ContractQuery{
+		IDPrefix: id,
+		Limit:    1,
+	})
 	if err != nil {
 		return err
-	}
-	var contract muse.Contract
-	for _, contract = range contracts {
-		if strings.HasPrefix(contract.ID.String(), id) {
-			break
-		}
-	}
-	if len(contract.RenterKey) == 0 {
+	} else if len(contracts) == 0 {
 		return errors.New("contract not found")
 	}
+	contract := contracts[0]
 
 	hostIP, err := sc.ResolveHostKey(contract.HostKey)
 	if err != nil {
@@ -11,6 +11,7 @@ import (
 	"github.com/BurntSushi/toml"
 	"go.sia.tech/siad/build"
 	"lukechampine.com/flagg"
+	"lukechampine.com/muse"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 )
@@ -29,23 +30,29 @@ Actions:
     scan            scan a host
     form            form a contract
     renew           renew a contract
+    refresh         top up a contract's funds
     contracts       list all contracts
     hosts           view and create host sets
     checkup         check the health of a contract
     info            display info about a contract
+    history         view the audit log
 `
 	versionUsage = rootUsage
 	scanUsage    = `Usage:
-    musec scan hostkey bytes duration
+    musec scan [flags] hostkey bytes duration
 
 Scans the specified host and reports various metrics.
 
 bytes is the number of bytes intended to be stored on the host; duration is
 the number of blocks that the contract will be active.
+
+If the server has scanned the host recently, the results of that scan are
+used. Use -f to force a new scan.
 `
 	formUsage = `Usage:
     musec form hostkey funds duration
     musec form hostkey funds @endheight
+    musec form -hostset name funds duration
 
 Forms a contract with the specified host for the specified duration with the
 specified amount of funds. To specify an exact end height for the contract,
@@ -53,11 +60,15 @@ use @endheight; otherwise, the end height will be the current height plus the
 supplied duration. Due to various fees, the total number of coins deducted
 from the wallet may be greater than funds. Run 'musec scan' on the host to see
 a breakdown of these fees.
+
+If -hostset is supplied, a contract is formed with each host in the set that
+lacks an active contract, and the outcome for each host is reported.
 `
 	renewUsage = `Usage:
     musec renew contract funds duration
     musec renew contract funds @endheight
     musec renew contract funds +extension
+    musec renew -hostset name [-funds policy] funds duration
 
 Renews the contract with the specified ID for the specified duration and with
 the specified amount of funds. Like 'musec form', an exact end height can be
@@ -65,6 +76,23 @@ specified using the @ prefix; additionally, a + prefix will set the end height
 equal to the old contract end height plus the supplied extension. Due to various
 fees, the total number of coins deducted from the wallet may be greater than
 funds. Run 'musec scan' on the host to see a breakdown of these fees.
+
+If -hostset is supplied, the latest contract with each host in the set is
+renewed, and the outcome for each host is reported. The -funds flag controls
+how much each contract is renewed with: 'fixed' uses the supplied funds,
+'same' uses the funds that the previous contract was formed with, and 'usage'
+extrapolates from the previous contract's spending, using the supplied funds
+as a minimum.
+`
+	refreshUsage = `Usage:
+    musec refresh contract
+    musec refresh contract funds
+
+Refreshes the contract with the specified ID by renewing it with the specified
+amount of funds while keeping its current end height. This is useful when a
+contract has run out of funds before its end height. If funds are not
+supplied, the contract is refreshed with the funds it was formed or renewed
+with.
 `
 	checkupUsage = `Usage:
     musec checkup contract
@@ -87,6 +115,8 @@ Actions:
 	delete          delete a host set
 	add             add a host to a host set
 	remove          remove a host from a host set
+	block           block or allow hosts
+	recommend       recommend hosts for a host set
 
 Lists host sets.
 `
@@ -110,11 +140,51 @@ Adds a host to the host set with the given name.
 musec hosts remove [name] [host]
 
 Removes a host from the host set with the given name.
+`
+	hostsBlockUsage = `Usage:
+musec hosts block
+musec hosts block [-allow] [-reason text] [host or network]
+musec hosts block remove [id]
+
+Lists, adds, or removes host rules. A rule applies either to a single host or
+to every host whose announced address lies within a network range (e.g.
+203.0.113.0/24). The server refuses to form or renew contracts with blocked
+hosts, or to add them to host sets. If -allow is supplied, an allow rule is
+added instead; once any allow rules exist, only hosts matching one of them are
+permitted.
+
+Rules added with the admin key apply to every tenant; rules added with a
+tenant key apply only to that tenant.
+`
+	hostsBlockRemoveUsage = `Usage:
+musec hosts block remove [id]
+
+Removes the host rule with the given ID.
+`
+	hostsRecommendUsage = `Usage:
+musec hosts recommend [flags] [n]
+
+Recommends n hosts, ranked by their price, collateral, uptime, latency, and
+remaining storage. Prices are compared using the estimated cost of storing,
+uploading, and downloading -storage bytes for -duration blocks. Only hosts that
+the server has scanned before are considered, and hosts that are blocked or
+violate the server's price limits are never recommended.
+
+If -create is supplied, a host set with the given name is created from the
+recommended hosts.
 `
 	infoUsage = `Usage:
     musec info contract
 
 Displays metadata about the contract with the specified ID.
+`
+	historyUsage = `Usage:
+    musec history [flags] [target]
+
+Displays the audit log, which records every state-changing API call (forming,
+renewing, and deleting contracts, and modifying host sets, renew policies, and
+budgets). If a target (a contract ID or host set name) is provided, only the
+entries affecting that target are displayed.
 `
 )
 
@@ -136,32 +206,49 @@ func scanHost(hkr renter.HostKeyResolver, pubkey hostdb.HostPublicKey) (hostdb.S
 	return hostdb.Scan(ctx, addr, pubkey)
 }
 
-func loadAddrFromConfig() string {
+type config struct {
+	MuseAddr   string `toml:"muse_addr"`
+	MuseAPIKey string `toml:"muse_api_key"`
+}
+
+func loadConfig() (config config) {
 	user, err := user.Current()
 	if err != nil {
-		return ""
-	}
-	var config struct {
-		MuseAddr string `toml:"muse_addr"`
+		return
 	}
 	toml.DecodeFile(filepath.Join(user.HomeDir, ".config", "user", "config.toml"), &config)
-	return config.MuseAddr
+	return
+}
+
+// museAPIKey is the key used to authenticate with the muse server, if any.
+var museAPIKey string
+
+func newClient(museAddr string) *muse.Client {
+	return muse.NewClient(museAddr).WithAPIKey(museAPIKey)
 }
 
 func main() {
 	log.SetFlags(0)
 
-	// read server addr from user config file, if it exists
-	museAddr := loadAddrFromConfig()
+	// read server addr and API key from user config file, if it exists
+	config := loadConfig()
+	museAddr := config.MuseAddr
+	museAPIKey = config.MuseAPIKey
 
 	rootCmd := flagg.Root
 	rootCmd.StringVar(&museAddr, "a", museAddr, "host:port that the muse API is running on")
+	rootCmd.StringVar(&museAPIKey, "k", museAPIKey, "API key used to authenticate with the muse server")
 	rootCmd.Usage = flagg.SimpleUsage(rootCmd, rootUsage)
 
 	versionCmd := flagg.New("version", versionUsage)
 	scanCmd := flagg.New("scan", scanUsage)
+	forceScan := scanCmd.Bool("f", false, "force a new scan, rather than using cached results")
 	formCmd := flagg.New("form", formUsage)
+	formSet := formCmd.String("hostset", "", "form contracts with every host in this host set")
 	renewCmd := flagg.New("renew", renewUsage)
+	renewSet := renewCmd.String("hostset", "", "renew the latest contract with every host in this host set")
+	renewFunds := renewCmd.String("funds", muse.FundsFixed, "funds policy for -hostset (fixed, same, or usage)")
+	refreshCmd := flagg.New("refresh", refreshUsage)
 	checkupCmd := flagg.New("checkup", checkupUsage)
 	contractsCmd := flagg.New("contracts", contractsUsage)
 	hostsCmd := flagg.New("hosts", hostsUsage)
@@ -169,7 +256,20 @@ func main() {
 	hostsDeleteCmd := flagg.New("delete", hostsDeleteUsage)
 	hostsAddCmd := flagg.New("add", hostsAddUsage)
 	hostsRemoveCmd := flagg.New("remove", hostsRemoveUsage)
+	hostsBlockCmd := flagg.New("block", hostsBlockUsage)
+	blockAllow := hostsBlockCmd.Bool("allow", false, "add an allow rule instead of a block rule")
+	blockReason := hostsBlockCmd.String("reason", "", "reason for the rule")
+	hostsBlockRemoveCmd := flagg.New("remove", hostsBlockRemoveUsage)
+	hostsRecommendCmd := flagg.New("recommend", hostsRecommendUsage)
+	recCreate := hostsRecommendCmd.String("create", "", "create a host set with this name from the recommended hosts")
+	recStorage := hostsRecommendCmd.String("storage", "1GB", "amount of data to be stored on each host")
+	recDuration := hostsRecommendCmd.Int("duration", 4320, "contract duration, in blocks")
+	recMinUptime := hostsRecommendCmd.Float64("min-uptime", 0.9, "minimum fraction of successful scans")
 	infoCmd := flagg.New("info", infoUsage)
+	historyCmd := flagg.New("history", historyUsage)
+	historyAction := historyCmd.String("action", "", "only display entries with this action (e.g. delete, hostset)")
+	historyLimit := historyCmd.Int("n", 0, "only display the n most recent entries")
+	historyVerbose := historyCmd.Bool("v", false, "display the state of the target before and after each change")
 
 	cmd := flagg.Parse(flagg.Tree{
 		Cmd: rootCmd,
@@ -178,6 +278,7 @@ func main() {
 			{Cmd: scanCmd},
 			{Cmd: formCmd},
 			{Cmd: renewCmd},
+			{Cmd: refreshCmd},
 			{Cmd: checkupCmd},
 			{Cmd: contractsCmd},
 			{Cmd: hostsCmd, Sub: []flagg.Tree{
@@ -185,8 +286,13 @@ func main() {
 				{Cmd: hostsAddCmd},
 				{Cmd: hostsRemoveCmd},
 				{Cmd: hostsDeleteCmd},
+				{Cmd: hostsBlockCmd, Sub: []flagg.Tree{
+					{Cmd: hostsBlockRemoveCmd},
+				}},
+				{Cmd: hostsRecommendCmd},
 			}},
 			{Cmd: infoCmd},
+			{Cmd: historyCmd},
 		},
 	})
 	args := cmd.Args()
@@ -204,19 +310,36 @@ func main() {
 
 	case scanCmd:
 		hostkey, bytes, duration := parseScan(args, scanCmd)
-		err := scan(museAddr, hostkey, bytes, duration)
+		err := scan(museAddr, hostkey, bytes, duration, *forceScan)
 		check("Scan failed:", err)
 
 	case formCmd:
+		if *formSet != "" {
+			funds, end := parseFormHostSet(args, formCmd)
+			err := formHostSet(museAddr, *formSet, funds, end)
+			check("Contract formation failed:", err)
+			break
+		}
 		host, funds, end := parseForm(args, formCmd)
 		err := form(museAddr, host, funds, end)
 		check("Contract formation failed:", err)
 
 	case renewCmd:
+		if *renewSet != "" {
+			funds, end := parseFormHostSet(args, renewCmd)
+			err := renewHostSet(museAddr, *renewSet, *renewFunds, funds, end)
+			check("Renew failed:", err)
+			break
+		}
 		contract, funds, end := parseRenew(args, renewCmd)
 		err := renew(museAddr, contract, funds, end)
 		check("Renew failed:", err)
 
+	case refreshCmd:
+		contract, funds := parseRefresh(args, refreshCmd)
+		err := refresh(museAddr, contract, funds)
+		check("Refresh failed:", err)
+
 	case checkupCmd:
 		if len(args) != 1 {
 			cmd.Usage()
@@ -267,6 +390,31 @@ func main() {
 		err := removeHost(museAddr, args[0], args[1])
 		check("Could not remove host:", err)
 
+	case hostsBlockCmd:
+		if len(args) == 0 {
+			err := listHostRules(museAddr)
+			check("Could not list host rules:", err)
+			break
+		} else if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := addHostRule(museAddr, args[0], *blockAllow, *blockReason)
+		check("Could not add host rule:", err)
+
+	case hostsBlockRemoveCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		err := removeHostRule(museAddr, args[0])
+		check("Could not remove host rule:", err)
+
+	case hostsRecommendCmd:
+		n := parseRecommend(args, hostsRecommendCmd)
+		err := recommendHosts(museAddr, n, parseFilesize(*recStorage), *recDuration, *recMinUptime, *recCreate)
+		check("Could not recommend hosts:", err)
+
 	case infoCmd:
 		if len(args) != 1 {
 			infoCmd.Usage()
@@ -274,5 +422,10 @@ func main() {
 		}
 		err := info(museAddr, args[0])
 		check("Could not get contract info:", err)
+
+	case historyCmd:
+		target := parseHistory(args, historyCmd)
+		err := history(museAddr, target, *historyAction, *historyLimit, *historyVerbose)
+		check("Could not get history:", err)
 	}
 }
@@ -23,6 +23,16 @@ func parseForm(args []string, cmd *flag.FlagSet) (string, types.Currency, string
 	return args[0], parseCurrency(args[1]), args[2]
 }
 
+// form -hostset [name] [funds] [endheight/duration]
+// renew -hostset [name] [funds] [endheight/duration]
+func parseFormHostSet(args []string, cmd *flag.FlagSet) (types.Currency, string) {
+	if len(args) != 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	return parseCurrency(args[0]), args[1]
+}
+
 // renew [contract] [funds] [endheight/duration]
 func parseRenew(args []string, cmd *flag.FlagSet) (string, types.Currency, string) {
 	if len(args) != 3 {
@@ -32,6 +42,33 @@ func parseRenew(args []string, cmd *flag.FlagSet) (string, types.Currency, strin
 	return args[0], parseCurrency(args[1]), args[2]
 }
 
+// refresh [contract]
+// refresh [contract] [funds]
+func parseRefresh(args []string, cmd *flag.FlagSet) (string, types.Currency) {
+	if len(args) != 1 && len(args) != 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	funds := types.ZeroCurrency
+	if len(args) == 2 {
+		funds = parseCurrency(args[1])
+	}
+	return args[0], funds
+}
+
+// hosts recommend [n]
+func parseRecommend(args []string, cmd *flag.FlagSet) int {
+	if len(args) != 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		check("Malformed host count:", fmt.Errorf("%q is not a positive integer", args[0]))
+	}
+	return n
+}
+
 // contracts
 // contracts [host set]
 func parseContracts(args []string, cmd *flag.FlagSet) string {
@@ -43,6 +80,16 @@ func parseContracts(args []string, cmd *flag.FlagSet) string {
 	return args[0]
 }
 
+// history [target]
+func parseHistory(args []string, cmd *flag.FlagSet) string {
+	if len(args) > 1 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	args = append(args, "")
+	return args[0]
+}
+
 // scan [hostkey] [bytes] [duration]
 func parseScan(args []string, cmd *flag.FlagSet) (string, uint64, types.BlockHeight) {
 	if len(args) != 3 {
@@ -0,0 +1,147 @@
+package muse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// parseContractQuery parses the filtering, sorting, and pagination parameters
+// of a /contracts request.
+func parseContractQuery(req *http.Request) (q ContractQuery, err error) {
+	q.HostSet = req.FormValue("hostset")
+	q.Archived = req.FormValue("archived") == "true"
+	q.HostKey = hostdb.HostPublicKey(req.FormValue("host"))
+	q.IDPrefix = strings.ToLower(req.FormValue("idPrefix"))
+	q.Cursor = req.FormValue("cursor")
+
+	switch q.Status = req.FormValue("status"); q.Status {
+	case "", "active", "expired":
+	default:
+		return ContractQuery{}, fmt.Errorf("Invalid status %q", q.Status)
+	}
+	switch q.Sort = req.FormValue("sort"); strings.TrimPrefix(q.Sort, "-") {
+	case "", "id", "endHeight":
+	default:
+		return ContractQuery{}, fmt.Errorf("Invalid sort %q", q.Sort)
+	}
+	parseHeight := func(name string) (types.BlockHeight, error) {
+		v := req.FormValue(name)
+		if v == "" {
+			return 0, nil
+		}
+		h, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %v: %v", name, err)
+		}
+		return types.BlockHeight(h), nil
+	}
+	if q.MinEndHeight, err = parseHeight("minEndHeight"); err != nil {
+		return ContractQuery{}, err
+	}
+	if q.MaxEndHeight, err = parseHeight("maxEndHeight"); err != nil {
+		return ContractQuery{}, err
+	}
+	if v := req.FormValue("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return ContractQuery{}, fmt.Errorf("Invalid limit %q", v)
+		}
+	}
+	if q.Cursor != "" {
+		if _, err := decodeCursor(q.Cursor); err != nil {
+			return ContractQuery{}, err
+		}
+	}
+	// pagination requires a total order
+	if q.Sort == "" && (q.Limit != 0 || q.Cursor != "") {
+		q.Sort = "id"
+	}
+	return q, nil
+}
+
+// isActive reports whether c is active at the specified height. Contracts are
+// active until the chain reaches their end height, and expired thereafter.
+func isActive(c Contract, height types.BlockHeight) bool {
+	return height < c.EndHeight
+}
+
+// matches reports whether c satisfies the filters of q.
+func (q ContractQuery) matches(c Contract, height types.BlockHeight) bool {
+	return (q.HostKey == "" || c.HostKey == q.HostKey) &&
+		(q.Status != "active" || isActive(c, height)) &&
+		(q.Status != "expired" || !isActive(c, height)) &&
+		c.EndHeight >= q.MinEndHeight &&
+		(q.MaxEndHeight == 0 || c.EndHeight <= q.MaxEndHeight) &&
+		strings.HasPrefix(c.ID.String(), q.IDPrefix)
+}
+
+// contractLess reports whether a sorts before b in the specified order. Ties
+// are broken by ID, so the order is total.
+func contractLess(order string, a, b Contract) bool {
+	if strings.HasPrefix(order, "-") {
+		a, b = b, a
+	}
+	if strings.TrimPrefix(order, "-") == "endHeight" && a.EndHeight != b.EndHeight {
+		return a.EndHeight < b.EndHeight
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// A cursor records the position of the last contract in a page. It holds the
+// contract's sort keys rather than its index, so that pages remain consistent
+// when contracts are added or removed between requests.
+func encodeCursor(c Contract) string {
+	return fmt.Sprintf("%d-%v", c.EndHeight, c.ID)
+}
+
+func decodeCursor(s string) (Contract, error) {
+	errInvalid := errors.New("Invalid cursor")
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return Contract{}, errInvalid
+	}
+	h, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return Contract{}, errInvalid
+	}
+	var c Contract
+	c.EndHeight = types.BlockHeight(h)
+	if err := c.ID.LoadString(s[i+1:]); err != nil {
+		return Contract{}, errInvalid
+	}
+	return c, nil
+}
+
+// queryContracts filters, sorts, and paginates cs according to q, returning
+// the requested page and the cursor of the next page, if any.
+func queryContracts(cs []Contract, q ContractQuery, height types.BlockHeight) ([]Contract, string) {
+	filtered := cs[:0]
+	for _, c := range cs {
+		if q.matches(c, height) {
+			filtered = append(filtered, c)
+		}
+	}
+	if q.Sort != "" {
+		sort.Slice(filtered, func(i, j int) bool {
+			return contractLess(q.Sort, filtered[i], filtered[j])
+		})
+	}
+	if q.Cursor != "" {
+		cursor, _ := decodeCursor(q.Cursor)
+		filtered = filtered[sort.Search(len(filtered), func(i int) bool {
+			return contractLess(q.Sort, cursor, filtered[i])
+		}):]
+	}
+	if q.Limit == 0 || len(filtered) <= q.Limit {
+		return filtered, ""
+	}
+	page := filtered[:q.Limit]
+	return page, encodeCursor(page[len(page)-1])
+}
@@ -0,0 +1,54 @@
+package muse
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+// encryptedPrefix identifies encrypted server state. Plaintext state is
+// always a JSON object, so it can never begin with this prefix.
+var encryptedPrefix = []byte("muse-xchacha20poly1305\n")
+
+// WithEncryptionKey causes the server to encrypt contracts (which contain
+// renter private keys) before writing them to disk. Contracts that were
+// previously stored in plaintext are encrypted when the server starts. Once
+// contracts have been encrypted, the server cannot start without the key.
+func WithEncryptionKey(key [32]byte) ServerOption {
+	return func(s *server) {
+		s.aead, _ = chacha20poly1305.NewX(key[:])
+	}
+}
+
+// seal encrypts data if the server has an encryption key; otherwise, it
+// returns data unchanged.
+func (s *server) seal(data []byte) []byte {
+	if s.aead == nil {
+		return data
+	}
+	nonce := frand.Bytes(s.aead.NonceSize())
+	sealed := append(append([]byte(nil), encryptedPrefix...), nonce...)
+	return s.aead.Seal(sealed, nonce, data, nil)
+}
+
+// unseal decrypts data that was encrypted by seal. It also reports whether
+// the data was encrypted.
+func (s *server) unseal(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, encryptedPrefix) {
+		return data, false, nil
+	} else if s.aead == nil {
+		return nil, true, errors.New("data is encrypted, but no encryption key was supplied")
+	}
+	data = data[len(encryptedPrefix):]
+	if len(data) < s.aead.NonceSize() {
+		return nil, true, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, true, errors.New("could not decrypt data; wrong encryption key?")
+	}
+	return plaintext, true, nil
+}
@@ -0,0 +1,48 @@
+package muse
+
+import (
+	"errors"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// EstimateFunds estimates the cost of a contract with a host that has the
+// specified settings, formed at the specified height and lasting for the
+// specified duration. The estimate's Funds field is the value that should be
+// passed to Form or Renew.
+func EstimateFunds(settings hostdb.HostSettings, target FundsTarget, height, duration types.BlockHeight) FundsEstimate {
+	return estimateFunds(settings, target, nil, height, height+duration)
+}
+
+// estimateFunds estimates the cost of forming a contract with a host that has
+// the specified settings or, if old is not nil, of renewing old with it. The
+// host's fee, collateral, and siafund fee are computed as in estimateCost.
+func estimateFunds(settings hostdb.HostSettings, target FundsTarget, old *Contract, start, end types.BlockHeight) FundsEstimate {
+	var e FundsEstimate
+	e.StorageCost = settings.StoragePrice.Mul64(target.Storage).Mul64(uint64(end - start))
+	e.UploadCost = settings.UploadBandwidthPrice.Mul64(target.Upload)
+	e.DownloadCost = settings.DownloadBandwidthPrice.Mul64(target.Download)
+	e.Funds = e.StorageCost.Add(e.UploadCost).Add(e.DownloadCost)
+	e.HostFee, e.HostCollateral = contractPayout(settings, old, e.Funds, start, end)
+	payout := e.Funds.Add(e.HostFee).Add(e.HostCollateral)
+	e.SiafundFee = taxAdjustedPayout(payout).Sub(payout)
+	e.TotalCost = e.Funds.Add(e.HostFee).Add(e.SiafundFee)
+	return e
+}
+
+// requestFunds returns the funds for a /form or /renew request. If target is
+// nil, funds is returned as-is; otherwise, the funds are estimated from the
+// target, and the estimate is returned as well. old is the contract being
+// renewed, or nil.
+func requestFunds(funds types.Currency, target *FundsTarget, settings hostdb.HostSettings, old *Contract, start, end types.BlockHeight) (types.Currency, *FundsEstimate, error) {
+	if target == nil {
+		return funds, nil, nil
+	} else if !funds.IsZero() {
+		return types.ZeroCurrency, nil, errors.New("Funds and Target are mutually exclusive")
+	} else if end <= start {
+		return types.ZeroCurrency, nil, errors.New("End height must be greater than start height")
+	}
+	e := estimateFunds(settings, *target, old, start, end)
+	return e.Funds, &e, nil
+}
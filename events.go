@@ -0,0 +1,219 @@
+package muse
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/frand"
+)
+
+const (
+	// expiryNotice is how many blocks before a contract's end height the
+	// server sends an EventExpiring event for it.
+	expiryNotice = 144
+
+	// subscriberBuffer is the number of events buffered for each /events
+	// subscriber. Subscribers that fall further behind are disconnected.
+	subscriberBuffer = 64
+
+	// eventHeartbeat is how often the server writes a comment to an idle
+	// /events stream, so that proxies do not close it.
+	eventHeartbeat = 30 * time.Second
+)
+
+func validEventType(typ string) bool {
+	switch typ {
+	case EventForm, EventRenew, EventDelete, EventRestore, EventHostSet,
+		EventExpiring, EventRenewFailed, EventHostOffline, EventHostReplaced:
+		return true
+	}
+	return false
+}
+
+// eventVisible reports whether ev should be sent to a consumer (a webhook or
+// /events subscriber) created by the specified tenant and interested in the
+// specified event types. An empty list of types denotes all types.
+func eventVisible(ev Event, tenant string, types []string) bool {
+	if tenant != "" && tenant != ev.Tenant {
+		return false
+	}
+	if len(types) == 0 {
+		return true
+	}
+	for _, typ := range types {
+		if typ == ev.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// A subscriber receives events via /events.
+type subscriber struct {
+	tenant string
+	types  []string
+	ch     chan Event
+}
+
+// notify sends ev to each webhook and subscriber that wants it. Webhook
+// deliveries happen in the background.
+func (s *server) notify(ev Event) {
+	ev.ID = hex.EncodeToString(frand.Bytes(8))
+	ev.Time = time.Now()
+	s.eventMu.Lock()
+	var hooks []Webhook
+	for _, h := range s.webhooks {
+		if eventVisible(ev, h.Tenant, h.Events) {
+			hooks = append(hooks, h)
+		}
+	}
+	for sub := range s.subscribers {
+		if !eventVisible(ev, sub.tenant, sub.types) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// the subscriber has fallen behind; disconnect it, rather than
+			// let it silently miss events
+			delete(s.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	s.eventMu.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		s.log.Error("could not encode webhook event", "event", ev.Type, "err", err)
+		return
+	}
+	for _, h := range hooks {
+		go s.deliver(h, ev, body)
+	}
+}
+
+// notifyContract sends a contract event.
+func (s *server) notifyContract(typ string, c Contract, err error) {
+	ev := Event{
+		Type:     typ,
+		HostKey:  c.HostKey,
+		Tenant:   c.Tenant,
+		Contract: &c,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.notify(ev)
+}
+
+// notifyRenewFailed sends an EventRenewFailed event for c, unless one has
+// already been sent. Automatic renewals are retried periodically, and
+// subscribers only need to hear about each failing contract once.
+func (s *server) notifyRenewFailed(c Contract, err error) {
+	s.mu.Lock()
+	notified := s.renewFailNotified[c.ID]
+	s.renewFailNotified[c.ID] = true
+	s.mu.Unlock()
+	if !notified {
+		s.notifyContract(EventRenewFailed, c, err)
+	}
+}
+
+// notifyExpiring sends an EventExpiring event for each contract that has not
+// been renewed and will expire within expiryNotice blocks. Each contract is
+// only reported once.
+func (s *server) notifyExpiring(height types.BlockHeight) {
+	s.mu.Lock()
+	ids := make(map[types.FileContractID]struct{}, len(s.contracts))
+	for _, c := range s.contracts {
+		ids[c.ID] = struct{}{}
+	}
+	var expiring []Contract
+	for _, c := range s.contracts {
+		if _, renewed := ids[c.RenewedTo]; renewed || s.expiryNotified[c.ID] {
+			continue
+		}
+		if isActive(c, height) && c.EndHeight <= height+expiryNotice {
+			s.expiryNotified[c.ID] = true
+			expiring = append(expiring, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range expiring {
+		s.notifyContract(EventExpiring, c, nil)
+	}
+}
+
+func (s *server) unsubscribe(sub *subscriber) {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (s *server) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if v := req.FormValue("events"); v != "" {
+		types = strings.Split(v, ",")
+		for _, typ := range types {
+			if !validEventType(typ) {
+				writeError(w, fmt.Sprintf("Unknown event type %q", typ), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	sub := &subscriber{
+		tenant: requestTenant(req),
+		types:  types,
+		ch:     make(chan Event, subscriberBuffer),
+	}
+	s.eventMu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.eventMu.Unlock()
+	defer s.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			js, err := json.Marshal(ev)
+			if err != nil {
+				s.log.Error("could not encode event", "event", ev.Type, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", ev.ID, ev.Type, js)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -6,7 +6,9 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/pkg/errors v0.9.1
 	gitlab.com/NebulousLabs/encoding v0.0.0-20200604091946-456c3dc907fe
+	go.etcd.io/bbolt v1.3.6
 	go.sia.tech/siad v1.5.7
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/term v0.0.0-20210421210424-b80969c67360
 	lukechampine.com/flagg v1.1.1
 	lukechampine.com/frand v1.4.2
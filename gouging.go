@@ -0,0 +1,194 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// WithPriceLimits sets the server-wide price limits. The server will not form
+// or renew contracts with hosts whose settings violate the limits. Host sets
+// may override individual limits via the /hostsets/:name/pricelimits
+// endpoint.
+func WithPriceLimits(limits PriceLimits) ServerOption {
+	return func(s *server) {
+		s.priceLimits = limits
+	}
+}
+
+// isZero reports whether l imposes no limits.
+func (l PriceLimits) isZero() bool {
+	return l.MaxStoragePrice.IsZero() && l.MaxUploadPrice.IsZero() &&
+		l.MaxDownloadPrice.IsZero() && l.MaxContractPrice.IsZero() &&
+		l.MinCollateralRatio == 0 && l.MaxWindowSize == 0
+}
+
+// override returns a copy of l, with each nonzero limit of o replacing the
+// corresponding limit of l.
+func (l PriceLimits) override(o PriceLimits) PriceLimits {
+	if !o.MaxStoragePrice.IsZero() {
+		l.MaxStoragePrice = o.MaxStoragePrice
+	}
+	if !o.MaxUploadPrice.IsZero() {
+		l.MaxUploadPrice = o.MaxUploadPrice
+	}
+	if !o.MaxDownloadPrice.IsZero() {
+		l.MaxDownloadPrice = o.MaxDownloadPrice
+	}
+	if !o.MaxContractPrice.IsZero() {
+		l.MaxContractPrice = o.MaxContractPrice
+	}
+	if o.MinCollateralRatio != 0 {
+		l.MinCollateralRatio = o.MinCollateralRatio
+	}
+	if o.MaxWindowSize != 0 {
+		l.MaxWindowSize = o.MaxWindowSize
+	}
+	return l
+}
+
+// check returns an error naming the first limit that settings violate, if
+// any.
+func (l PriceLimits) check(settings hostdb.HostSettings) error {
+	exceeds := func(name string, price, max types.Currency) error {
+		if !max.IsZero() && price.Cmp(max) > 0 {
+			return fmt.Errorf("host violates %v: price of %v exceeds limit of %v", name, price, max)
+		}
+		return nil
+	}
+	if err := exceeds("maxStoragePrice", settings.StoragePrice, l.MaxStoragePrice); err != nil {
+		return err
+	} else if err := exceeds("maxUploadPrice", settings.UploadBandwidthPrice, l.MaxUploadPrice); err != nil {
+		return err
+	} else if err := exceeds("maxDownloadPrice", settings.DownloadBandwidthPrice, l.MaxDownloadPrice); err != nil {
+		return err
+	} else if err := exceeds("maxContractPrice", settings.ContractPrice, l.MaxContractPrice); err != nil {
+		return err
+	}
+	if l.MinCollateralRatio > 0 && !settings.StoragePrice.IsZero() {
+		ratio := new(big.Rat).SetFrac(settings.Collateral.Big(), settings.StoragePrice.Big())
+		if min := new(big.Rat).SetFloat64(l.MinCollateralRatio); min != nil && ratio.Cmp(min) < 0 {
+			return fmt.Errorf("host violates minCollateralRatio: collateral ratio of %v is less than %v", ratio.FloatString(2), l.MinCollateralRatio)
+		}
+	}
+	if l.MaxWindowSize != 0 && settings.WindowSize > l.MaxWindowSize {
+		return fmt.Errorf("host violates maxWindowSize: window size of %v exceeds limit of %v", settings.WindowSize, l.MaxWindowSize)
+	}
+	return nil
+}
+
+// limitedSets returns the names of the host sets, owned by tenant and
+// containing hostKey, that override the server-wide price limits. The caller
+// must hold s.mu.
+func (s *server) limitedSets(tenant string, hostKey hostdb.HostPublicKey) []string {
+	var names []string
+	for name := range s.setPriceLimits {
+		if s.hostSetOwners[name] != tenant {
+			continue
+		}
+		for _, h := range s.hostSets[name] {
+			if h == hostKey {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// needsScan reports whether contracts formed with the specified host on behalf
+// of tenant are subject to price limits or a budget. If so, the host's settings
+// must be obtained by scanning it, rather than taken from the request.
+func (s *server) needsScan(tenant string, hostKey hostdb.HostPublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.priceLimits.isZero() || len(s.limitedSets(tenant, hostKey)) > 0 || len(s.budgetedSets(tenant, hostKey)) > 0
+}
+
+// checkPrices returns an error if the settings of the specified host violate
+// the server-wide price limits, or the limits of any host set, owned by the
+// specified tenant, that contains the host.
+func (s *server) checkPrices(tenant string, host hostdb.ScannedHost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := s.limitedSets(tenant, host.PublicKey)
+	if len(names) == 0 {
+		return s.priceLimits.check(host.HostSettings)
+	}
+	for _, name := range names {
+		if err := s.priceLimits.override(s.setPriceLimits[name]).check(host.HostSettings); err != nil {
+			return fmt.Errorf("%v (host set %q)", err, name)
+		}
+	}
+	return nil
+}
+
+func (s *server) handlePriceLimits(w http.ResponseWriter, req *http.Request, setName string) {
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		_, ok := s.hostSets[setName]
+		ok = ok && canAccess(req, s.hostSetOwners[setName])
+		limits := s.setPriceLimits[setName]
+		s.mu.Unlock()
+		if !ok {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		writeJSON(w, limits)
+
+	case http.MethodPut:
+		var limits PriceLimits
+		if err := json.NewDecoder(req.Body).Decode(&limits); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limits.MinCollateralRatio < 0 {
+			writeError(w, "Minimum collateral ratio must not be negative", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		if _, ok := s.hostSets[setName]; !ok || !canAccess(req, s.hostSetOwners[setName]) {
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		var before, after interface{}
+		if old, ok := s.setPriceLimits[setName]; ok {
+			before = old
+		}
+		if !limits.isZero() {
+			after = limits
+		}
+		ae := newAuditEntry(req, "pricelimits", setName, s.hostSetOwners[setName], "set price limits of host set "+setName, before, after)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			if limits.isZero() {
+				return tx.Delete(bucketPriceLimits, []byte(setName))
+			}
+			return putJSON(tx, bucketPriceLimits, []byte(setName), limits)
+		})
+		if err == nil {
+			s.setPriceLimits[setName] = limits
+			if limits.isZero() {
+				delete(s.setPriceLimits, setName)
+			}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,226 @@
+package muse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+func (s *server) handleHealPolicy(w http.ResponseWriter, req *http.Request, setName string) {
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		_, ok := s.hostSets[setName]
+		ok = ok && canAccess(req, s.hostSetOwners[setName])
+		policy := s.healPolicies[setName]
+		s.mu.Unlock()
+		if !ok {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		writeJSON(w, policy)
+
+	case http.MethodPut:
+		var policy HealPolicy
+		if err := json.NewDecoder(req.Body).Decode(&policy); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		enabled := policy.MaxFailedScans != 0 || policy.PriceBreach
+		if enabled && policy.Duration == 0 {
+			writeError(w, "Duration must be nonzero", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		if _, ok := s.hostSets[setName]; !ok || !canAccess(req, s.hostSetOwners[setName]) {
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		var before, after interface{}
+		if old, ok := s.healPolicies[setName]; ok {
+			before = old
+		}
+		if enabled {
+			after = policy
+		}
+		ae := newAuditEntry(req, "healpolicy", setName, s.hostSetOwners[setName], "set heal policy of host set "+setName, before, after)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			if !enabled {
+				return tx.Delete(bucketHealPolicies, []byte(setName))
+			}
+			return putJSON(tx, bucketHealPolicies, []byte(setName), policy)
+		})
+		if err == nil {
+			s.healPolicies[setName] = policy
+			if !enabled {
+				delete(s.healPolicies, setName)
+			}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// healReason returns the reason that the host should be replaced under
+// policy, or the empty string if it should not be replaced.
+func (s *server) healReason(policy HealPolicy, owner string, hostKey hostdb.HostPublicKey) string {
+	s.mu.Lock()
+	info, ok := s.hosts[hostKey]
+	s.mu.Unlock()
+	if !ok {
+		return ""
+	}
+	if policy.MaxFailedScans != 0 && info.ConsecutiveFailures >= policy.MaxFailedScans {
+		return fmt.Sprintf("%v consecutive scans failed: %v", info.ConsecutiveFailures, info.LastError)
+	}
+	if policy.PriceBreach && info.LastError == "" {
+		host := hostdb.ScannedHost{HostSettings: info.Settings, PublicKey: hostKey}
+		if err := s.checkPrices(owner, host); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// healHostSets replaces the failing hosts in each host set that has a heal
+// policy.
+func (s *server) healHostSets(height types.BlockHeight) {
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+
+	s.mu.Lock()
+	setNames := make([]string, 0, len(s.healPolicies))
+	for name := range s.healPolicies {
+		setNames = append(setNames, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(setNames)
+
+	for _, name := range setNames {
+		s.mu.Lock()
+		policy, ok := s.healPolicies[name]
+		set := append([]hostdb.HostPublicKey(nil), s.hostSets[name]...)
+		owner := s.hostSetOwners[name]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		for _, hostKey := range set {
+			reason := s.healReason(policy, owner, hostKey)
+			if reason == "" {
+				continue
+			}
+			if err := s.replaceHost(name, policy, owner, hostKey, reason, height); err != nil {
+				s.log.Warn("could not replace host", "hostSet", name, "hostKey", hostKey, "reason", reason, "err", err)
+			}
+		}
+	}
+}
+
+// replaceHost replaces hostKey in the named host set with the best available
+// host, forming a contract with the replacement.
+func (s *server) replaceHost(setName string, policy HealPolicy, owner string, hostKey hostdb.HostPublicKey, reason string, height types.BlockHeight) error {
+	log := s.log.With("autoHeal", true, "hostSet", setName, "replacedHost", hostKey)
+
+	// never pick a host that is already in the set
+	s.mu.Lock()
+	exclude := append([]hostdb.HostPublicKey(nil), s.hostSets[setName]...)
+	s.mu.Unlock()
+	scores := s.recommendHosts(owner, RequestRecommend{
+		Count:     1,
+		Target:    policy.Target,
+		Duration:  policy.Duration,
+		MinUptime: policy.MinUptime,
+		Exclude:   exclude,
+	}, height)
+	if len(scores) == 0 {
+		return errors.New("no suitable replacement host")
+	}
+	newKey := scores[0].HostKey
+
+	host, err := s.scanHost(newKey)
+	if err != nil {
+		return err
+	}
+	funds := policy.Funds
+	if funds.IsZero() {
+		funds = EstimateFunds(host.HostSettings, policy.Target, height, policy.Duration).Funds
+	}
+	release, err := s.reserveBudget(owner, host, nil, funds, height, height+policy.Duration)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ae := AuditEntry{Caller: "autoheal", Route: "autoheal", Action: "form"}
+	c, err := s.formContract(log, ae, owner, host, funds, height, height+policy.Duration)
+	if err != nil {
+		return err
+	}
+
+	// swap the hosts, unless the set was modified in the meantime
+	s.mu.Lock()
+	set := s.hostSets[setName]
+	hostKeys := make([]hostdb.HostPublicKey, 0, len(set))
+	var found bool
+	for _, h := range set {
+		if h == hostKey {
+			h, found = newKey, true
+		}
+		hostKeys = append(hostKeys, h)
+	}
+	if !found {
+		s.mu.Unlock()
+		return fmt.Errorf("host was removed from set before it could be replaced (contract %v was formed with the replacement)", c.ID)
+	}
+	sort.Slice(hostKeys, func(i, j int) bool {
+		return hostKeys[i] < hostKeys[j]
+	})
+	ae = AuditEntry{
+		Caller:  "autoheal",
+		Route:   "autoheal",
+		Action:  "hostset",
+		Target:  setName,
+		Tenant:  owner,
+		Summary: fmt.Sprintf("replaced host %v with %v in host set %v (%v)", hostKey, newKey, setName, reason),
+		Before:  auditState(set),
+		After:   auditState(hostKeys),
+	}
+	err = s.store.Update(func(tx Tx) error {
+		if err := s.putAudit(tx, ae); err != nil {
+			return err
+		}
+		return putJSON(tx, bucketHostSets, []byte(setName), hostKeys)
+	})
+	if err == nil {
+		s.hostSets[setName] = hostKeys
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Info("replaced host", "newHost", newKey, "contractID", c.ID, "reason", reason)
+	s.notify(Event{
+		Type:     EventHostReplaced,
+		Tenant:   owner,
+		HostKey:  hostKey,
+		HostSet:  setName,
+		Contract: &c,
+		Error:    reason,
+	})
+	return nil
+}
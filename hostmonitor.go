@@ -0,0 +1,275 @@
+package muse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+)
+
+const (
+	// monitorInterval is how often the server scans the hosts in its host
+	// sets.
+	monitorInterval = 30 * time.Minute
+
+	// scanCacheTTL is how long a successful scan is served from the cache
+	// by /scan.
+	scanCacheTTL = time.Hour
+
+	// maxSettingsHistory is the number of settings changes retained for each
+	// host.
+	maxSettingsHistory = 100
+)
+
+// pricesChanged reports whether any of the prices in a and b differ.
+func pricesChanged(a, b hostdb.HostSettings) bool {
+	return !a.ContractPrice.Equals(b.ContractPrice) ||
+		!a.StoragePrice.Equals(b.StoragePrice) ||
+		!a.UploadBandwidthPrice.Equals(b.UploadBandwidthPrice) ||
+		!a.DownloadBandwidthPrice.Equals(b.DownloadBandwidthPrice) ||
+		!a.Collateral.Equals(b.Collateral) ||
+		!a.MaxCollateral.Equals(b.MaxCollateral)
+}
+
+// scanHost scans the specified host and records the result.
+func (s *server) scanHost(hostKey hostdb.HostPublicKey) (hostdb.ScannedHost, error) {
+	hostAddr, err := s.resolveHostKey(hostKey)
+	if err != nil {
+		return hostdb.ScannedHost{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	host, scanErr := hostdb.Scan(ctx, hostAddr, hostKey)
+	s.metrics.observe("scan", start, scanErr)
+	if err := s.recordScan(hostKey, host, scanErr); err != nil {
+		s.log.Warn("could not record scan", "hostKey", hostKey, "err", err)
+	}
+	return host, scanErr
+}
+
+// recordScan updates the host's statistics with the result of a scan.
+func (s *server) recordScan(hostKey hostdb.HostPublicKey, host hostdb.ScannedHost, scanErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.hosts[hostKey]
+	if !ok {
+		info.PublicKey = hostKey
+	}
+	info.LastScan = time.Now()
+	info.TotalScans++
+	if scanErr != nil {
+		if ok && info.LastError == "" {
+			// notify each tenant that uses the host
+			for _, tenant := range s.hostTenants(hostKey) {
+				s.notify(Event{
+					Type:    EventHostOffline,
+					HostKey: hostKey,
+					Tenant:  tenant,
+					Error:   scanErr.Error(),
+				})
+			}
+		}
+		info.LastError = scanErr.Error()
+		info.ConsecutiveFailures++
+	} else {
+		info.LastError = ""
+		info.ConsecutiveFailures = 0
+		info.LastSuccess = info.LastScan
+		info.SuccessfulScans++
+		info.LastLatency = host.Latency
+		n := time.Duration(info.SuccessfulScans)
+		info.AverageLatency = (info.AverageLatency*(n-1) + host.Latency) / n
+		if len(info.SettingsHistory) == 0 || pricesChanged(info.Settings, host.HostSettings) {
+			info.SettingsHistory = append(info.SettingsHistory, SettingsChange{
+				Time:     info.LastScan,
+				Settings: host.HostSettings,
+			})
+			if len(info.SettingsHistory) > maxSettingsHistory {
+				info.SettingsHistory = append([]SettingsChange(nil), info.SettingsHistory[len(info.SettingsHistory)-maxSettingsHistory:]...)
+			}
+		}
+		info.Settings = host.HostSettings
+	}
+	err := s.store.Update(func(tx Tx) error {
+		return putJSON(tx, bucketHosts, []byte(hostKey), info)
+	})
+	if err == nil {
+		s.hosts[hostKey] = info
+	}
+	return err
+}
+
+// cachedScan returns the most recent successful scan of the host, if it is
+// recent enough.
+func (s *server) cachedScan(hostKey hostdb.HostPublicKey) (hostdb.ScannedHost, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.hosts[hostKey]
+	if !ok || info.LastSuccess.IsZero() || time.Since(info.LastSuccess) > scanCacheTTL {
+		return hostdb.ScannedHost{}, false
+	}
+	s.metrics.inc(&s.metrics.scanCacheHits)
+	return hostdb.ScannedHost{
+		HostSettings: info.Settings,
+		PublicKey:    hostKey,
+		Latency:      info.LastLatency,
+	}, true
+}
+
+func (s *server) monitorLoop() {
+	for {
+		s.monitorHosts()
+		s.discoverHosts()
+		if height, err := s.shard.ChainHeight(); err != nil {
+			s.log.Warn("could not determine chain height for host replacement", "err", err)
+		} else {
+			s.healHostSets(height)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(monitorInterval):
+		}
+	}
+}
+
+// monitorHosts scans every host in every host set.
+func (s *server) monitorHosts() {
+	s.mu.Lock()
+	seen := make(map[hostdb.HostPublicKey]bool)
+	var hostKeys []hostdb.HostPublicKey
+	for _, set := range s.hostSets {
+		for _, hostKey := range set {
+			if !seen[hostKey] {
+				seen[hostKey] = true
+				hostKeys = append(hostKeys, hostKey)
+			}
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(hostKeys, func(i, j int) bool {
+		return hostKeys[i] < hostKeys[j]
+	})
+
+	for _, hostKey := range hostKeys {
+		s.scanHost(hostKey) // errors are recorded
+	}
+}
+
+// hostTenants returns the tenants that have the specified host in one of their
+// host sets, or have formed a contract with it. If there are none, it returns
+// the empty tenant, so that the host is still reported to admin consumers.
+// The caller must hold s.mu.
+func (s *server) hostTenants(hostKey hostdb.HostPublicKey) []string {
+	seen := make(map[string]bool)
+	var tenants []string
+	add := func(tenant string) {
+		if !seen[tenant] {
+			seen[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+	for name, set := range s.hostSets {
+		for _, h := range set {
+			if h == hostKey {
+				add(s.hostSetOwners[name])
+				break
+			}
+		}
+	}
+	for _, cs := range [][]Contract{s.contracts, s.archive} {
+		for _, c := range cs {
+			if c.HostKey == hostKey {
+				add(c.Tenant)
+			}
+		}
+	}
+	if len(tenants) == 0 {
+		add("")
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// tenantHosts returns the hosts that are in a host set owned by the specified
+// tenant, or that the tenant has formed a contract with. The caller must hold
+// s.mu.
+func (s *server) tenantHosts(tenant string) map[hostdb.HostPublicKey]bool {
+	hosts := make(map[hostdb.HostPublicKey]bool)
+	for name, set := range s.hostSets {
+		if s.hostSetOwners[name] == tenant {
+			for _, hostKey := range set {
+				hosts[hostKey] = true
+			}
+		}
+	}
+	for _, cs := range [][]Contract{s.contracts, s.archive} {
+		for _, c := range cs {
+			if c.Tenant == tenant {
+				hosts[c.HostKey] = true
+			}
+		}
+	}
+	return hosts
+}
+
+func (s *server) handleHosts(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/hosts/recommend" {
+		s.handleRecommend(w, req)
+		return
+	} else if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hostKey := hostdb.HostPublicKey(strings.TrimPrefix(req.URL.Path, "/hosts/"))
+	if strings.Contains(string(hostKey), "/") {
+		writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// tenants may only see the hosts they use
+	var visible map[hostdb.HostPublicKey]bool
+	if tenant := requestTenant(req); tenant != "" {
+		visible = s.tenantHosts(tenant)
+	}
+	if hostKey == "" {
+		infos := make([]HostInfo, 0, len(s.hosts))
+		for _, info := range s.hosts {
+			if visible == nil || visible[info.PublicKey] {
+				infos = append(infos, info)
+			}
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].PublicKey < infos[j].PublicKey
+		})
+		writeJSON(w, infos)
+		return
+	}
+	info, ok := s.hosts[hostKey]
+	if !ok || (visible != nil && !visible[hostKey]) {
+		writeErrorKind(w, "No record of that host", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// loadHosts loads host statistics from the store.
+func (s *server) loadHosts(tx Tx) {
+	s.hosts = make(map[hostdb.HostPublicKey]HostInfo)
+	tx.ForEach(bucketHosts, func(key, value []byte) error {
+		var info HostInfo
+		if err := json.Unmarshal(value, &info); err != nil {
+			s.log.Warn("skipping corrupt host record", "hostKey", string(key), "err", err)
+			return nil
+		}
+		s.hosts[hostdb.HostPublicKey(key)] = info
+		return nil
+	})
+}
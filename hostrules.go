@@ -0,0 +1,216 @@
+package muse
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+)
+
+// matches reports whether r applies to the specified host, whose address
+// resolves to ips.
+func (r HostRule) matches(hostKey hostdb.HostPublicKey, ips []net.IP) bool {
+	if r.HostKey != "" {
+		return r.HostKey == hostKey
+	}
+	_, network, err := net.ParseCIDR(r.Network)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupIPs returns the IP addresses of a host's announced address.
+func lookupIPs(addr modules.NetAddress) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(host)
+}
+
+// checkHostRules returns an error if the host rules that apply to the
+// specified tenant forbid contracts with the specified host. The server-wide
+// rules apply to every tenant; a tenant's own rules apply only to that tenant.
+// Within each scope, a host is forbidden if it matches any block rule, or if
+// the scope has allow rules and the host matches none of them.
+func (s *server) checkHostRules(tenant string, hostKey hostdb.HostPublicKey) error {
+	s.mu.Lock()
+	var rules []HostRule
+	var needIPs bool
+	for _, r := range s.hostRules {
+		if r.Tenant == "" || r.Tenant == tenant {
+			rules = append(rules, r)
+			needIPs = needIPs || r.Network != ""
+		}
+	}
+	s.mu.Unlock()
+	if len(rules) == 0 {
+		return nil
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+
+	var ips []net.IP
+	if needIPs {
+		addr, err := s.resolveHostKey(hostKey)
+		if err != nil {
+			return fmt.Errorf("could not resolve host address to check host rules: %w", err)
+		}
+		if ips, err = lookupIPs(addr); err != nil {
+			return fmt.Errorf("could not resolve host address to check host rules: %w", err)
+		}
+	}
+
+	hasAllow := make(map[string]bool)
+	allowed := make(map[string]bool)
+	for _, r := range rules {
+		match := r.matches(hostKey, ips)
+		switch r.Action {
+		case HostRuleBlock:
+			if match {
+				msg := fmt.Sprintf("host %v is blocked by rule %v", hostKey, r.ID)
+				if r.Reason != "" {
+					msg += " (" + r.Reason + ")"
+				}
+				return errors.New(msg)
+			}
+		case HostRuleAllow:
+			hasAllow[r.Tenant] = true
+			allowed[r.Tenant] = allowed[r.Tenant] || match
+		}
+	}
+	if hasAllow[""] && !allowed[""] {
+		return fmt.Errorf("host %v is not on the server's allowlist", hostKey)
+	} else if tenant != "" && hasAllow[tenant] && !allowed[tenant] {
+		return fmt.Errorf("host %v is not on the tenant's allowlist", hostKey)
+	}
+	return nil
+}
+
+// loadHostRules loads the host rules from the store.
+func (s *server) loadHostRules(tx Tx) {
+	s.hostRules = make(map[string]HostRule)
+	tx.ForEach(bucketHostRules, func(key, value []byte) error {
+		var r HostRule
+		if err := json.Unmarshal(value, &r); err != nil {
+			s.log.Warn("skipping corrupt host rule", "rule", string(key), "err", err)
+			return nil
+		}
+		s.hostRules[r.ID] = r
+		return nil
+	})
+}
+
+func (s *server) handleHostRules(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/hostrules/")
+	switch req.Method {
+	case http.MethodGet:
+		if id != "" {
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.Lock()
+		var rules []HostRule
+		for _, r := range s.hostRules {
+			if r.Tenant == "" || canAccess(req, r.Tenant) {
+				rules = append(rules, r)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(rules, func(i, j int) bool {
+			return rules[i].ID < rules[j].ID
+		})
+		writeJSON(w, rules)
+
+	case http.MethodPost:
+		if id != "" {
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var r HostRule
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Action != HostRuleBlock && r.Action != HostRuleAllow {
+			writeError(w, fmt.Sprintf("Unknown rule action %q", r.Action), http.StatusBadRequest)
+			return
+		} else if (r.HostKey == "") == (r.Network == "") {
+			writeError(w, "Rule must specify exactly one of host key and network", http.StatusBadRequest)
+			return
+		} else if r.Network != "" {
+			if _, _, err := net.ParseCIDR(r.Network); err != nil {
+				writeError(w, "Invalid network: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		r.ID = hex.EncodeToString(frand.Bytes(8))
+		r.Tenant = requestTenant(req)
+		target := string(r.HostKey)
+		if r.Network != "" {
+			target = r.Network
+		}
+		ae := newAuditEntry(req, "hostrule", r.ID, r.Tenant, "added "+r.Action+" rule for "+target, nil, r)
+		s.mu.Lock()
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			return putJSON(tx, bucketHostRules, []byte(r.ID), r)
+		})
+		if err == nil {
+			s.hostRules[r.ID] = r
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r)
+
+	case http.MethodDelete:
+		s.mu.Lock()
+		r, ok := s.hostRules[id]
+		if !ok || !canAccess(req, r.Tenant) {
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that host rule", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		ae := newAuditEntry(req, "hostrule", r.ID, r.Tenant, "deleted "+r.Action+" rule "+r.ID, r, nil)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			return tx.Delete(bucketHostRules, []byte(r.ID))
+		})
+		if err == nil {
+			delete(s.hostRules, r.ID)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
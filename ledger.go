@@ -0,0 +1,356 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// newLedgerEntry returns a ledger entry for the contract formed or renewed by
+// txnSet. The entry records what the wallet spent on the contract, as computed
+// by proto.FormContract and proto.RenewContract.
+//
+// A renewal also pays the host's BaseRPCPrice out of the old contract's
+// remaining funds. That is not recorded here, because those funds were
+// already recorded when the old contract was formed or renewed.
+func newLedgerEntry(typ string, c Contract, host hostdb.ScannedHost, funds types.Currency, height types.BlockHeight, txnSet []types.Transaction) LedgerEntry {
+	e := LedgerEntry{
+		Type:       typ,
+		ContractID: c.ID,
+		HostKey:    c.HostKey,
+		Tenant:     c.Tenant,
+		Height:     height,
+		Funds:      funds,
+		HostFee:    host.ContractPrice,
+	}
+	// the contract transaction is always the last transaction in the set
+	if len(txnSet) > 0 {
+		txn := txnSet[len(txnSet)-1]
+		for _, fc := range txn.FileContracts {
+			// the tax is whatever part of the payout is not paid out
+			tax := fc.Payout
+			for _, sco := range fc.ValidProofOutputs {
+				tax = tax.Sub(sco.Value)
+			}
+			e.SiafundTax = e.SiafundTax.Add(tax)
+			// when renewing, the renter also pays for the storage of the data
+			// already in the contract. The void output holds that base price
+			// plus the matching base collateral, in proportion to the host's
+			// storage price and collateral.
+			if typ == "renew" && len(fc.MissedProofOutputs) == 3 {
+				if perByte := host.StoragePrice.Add(host.Collateral); !perByte.IsZero() {
+					basePrice := fc.MissedProofOutputs[2].Value.Mul(host.StoragePrice).Div(perByte)
+					e.HostFee = e.HostFee.Add(basePrice)
+				}
+			}
+		}
+		for _, fee := range txn.MinerFees {
+			e.TxnFee = e.TxnFee.Add(fee)
+		}
+	}
+	return e
+}
+
+// contractPayout returns the host's fee and collateral for a contract with
+// the specified funds, formed with a host that has the specified settings or,
+// if old is not nil, renewed from old. They are computed as in
+// proto.FormContract and proto.RenewContract; when renewing, the host's fee
+// includes the storage cost of the data already in the contract.
+func contractPayout(settings hostdb.HostSettings, old *Contract, funds types.Currency, start, end types.BlockHeight) (hostFee, collateral types.Currency) {
+	hostFee = settings.ContractPrice
+	if old == nil {
+		duration := uint64(end - start)
+		if blockBytes := settings.UploadBandwidthPrice.Add(settings.StoragePrice).Add(settings.DownloadBandwidthPrice).Mul64(duration); !blockBytes.IsZero() {
+			collateral = settings.Collateral.Mul(funds.Div(blockBytes)).Mul64(duration)
+		}
+	} else {
+		// the old contract's window is assumed to have the host's current
+		// window size
+		if newEnd, oldEnd := end+settings.WindowSize, old.EndHeight+settings.WindowSize; newEnd > oldEnd {
+			extension := uint64(newEnd - oldEnd)
+			hostFee = hostFee.Add(settings.StoragePrice.Mul64(old.NewFileSize).Mul64(extension))
+			collateral = settings.Collateral.Mul64(old.NewFileSize).Mul64(extension)
+		}
+		if perByte := settings.UploadBandwidthPrice.Add(settings.StoragePrice).Add(settings.DownloadBandwidthPrice); !perByte.IsZero() {
+			collateral = collateral.Add(settings.Collateral.Mul(funds.Div(perByte)))
+		}
+	}
+	if collateral.Cmp(settings.MaxCollateral) > 0 {
+		collateral = settings.MaxCollateral
+	}
+	return hostFee, collateral
+}
+
+// estimateCost returns a ledger entry estimating the cost of forming a
+// contract with host or, if old is not nil, of renewing old with host. The
+// siafund tax is computed on the whole payout, including the host's
+// collateral, as in proto; the transaction fee is not known in advance, so it
+// is not included.
+func estimateCost(host hostdb.ScannedHost, old *Contract, funds types.Currency, start, end, height types.BlockHeight) LedgerEntry {
+	hostFee, collateral := contractPayout(host.HostSettings, old, funds, start, end)
+	payout := funds.Add(hostFee).Add(collateral)
+	return LedgerEntry{
+		HostKey:    host.PublicKey,
+		Height:     height,
+		Funds:      funds,
+		HostFee:    hostFee,
+		SiafundTax: taxAdjustedPayout(payout).Sub(payout),
+	}
+}
+
+// taxAdjustedPayout returns the contract payout that, after the siafund tax,
+// leaves target for the renter and host. Copied from proto, which does not
+// export it.
+func taxAdjustedPayout(target types.Currency) types.Currency {
+	// compute initial guess as target * (1 / 1-tax); since this does not take
+	// the siafund rounding into account, the guess will be up to
+	// types.SiafundCount greater than the actual payout value.
+	guess := target.Big()
+	guess.Mul(guess, big.NewInt(1000))
+	guess.Div(guess, big.NewInt(961))
+
+	// now, adjust the guess to remove the rounding error. Since
+	// (target % types.SiafundCount) == (payout % types.SiafundCount), the
+	// guess can simply be adjusted to have the same remainder; since the guess
+	// is at least the payout, an extra types.SiafundCount must be subtracted
+	// if the guess's remainder is smaller.
+	sfc := types.SiafundCount.Big()
+	tm := new(big.Int).Mod(target.Big(), sfc)
+	gm := new(big.Int).Mod(guess, sfc)
+	if gm.Cmp(tm) < 0 {
+		guess.Sub(guess, sfc)
+	}
+	guess.Sub(guess, gm)
+	guess.Add(guess, tm)
+	return types.NewCurrency(guess)
+}
+
+// budgetedSets returns the names of the host sets, owned by the specified
+// tenant, that contain the specified host and have a budget. The caller must
+// hold s.mu.
+func (s *server) budgetedSets(tenant string, hostKey hostdb.HostPublicKey) []string {
+	var names []string
+	for name, b := range s.budgets {
+		if b.Period == 0 || s.hostSetOwners[name] != tenant {
+			continue
+		}
+		for _, h := range s.hostSets[name] {
+			if h == hostKey {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setSpending returns the total amount spent on the named host set between
+// the specified heights (inclusive). The caller must hold s.mu.
+func (s *server) setSpending(setName string, min, max types.BlockHeight) types.Currency {
+	inSet := make(map[hostdb.HostPublicKey]bool)
+	for _, h := range s.hostSets[setName] {
+		inSet[h] = true
+	}
+	owner := s.hostSetOwners[setName]
+	var spent types.Currency
+	for _, e := range s.ledger {
+		if inSet[e.HostKey] && e.Tenant == owner && min <= e.Height && e.Height <= max {
+			spent = spent.Add(e.Total())
+		}
+	}
+	for e := range s.budgetReserved {
+		if inSet[e.HostKey] && e.Tenant == owner && min <= e.Height && e.Height <= max {
+			spent = spent.Add(e.Total())
+		}
+	}
+	return spent
+}
+
+// reserveBudget returns an error if spending the estimated cost of forming a
+// contract with the specified host (or, if old is not nil, of renewing old
+// with it) at the current height would exceed the budget of any host set
+// containing the host. The current height
+// is obtained from the chain, never from the request, so that callers cannot
+// choose which budget period the spending counts against.
+//
+// Otherwise, the estimated cost is reserved against those budgets until the
+// returned function is called, so that concurrent formations and renewals
+// cannot collectively exceed a budget. It should be called once the
+// contract's ledger entry has been recorded, or the contract could not be
+// formed.
+func (s *server) reserveBudget(tenant string, host hostdb.ScannedHost, old *Contract, funds types.Currency, start, end types.BlockHeight) (func(), error) {
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine chain height: %w", err)
+	}
+	est := estimateCost(host, old, funds, start, end, height)
+	est.Tenant = tenant
+	reservation := &est
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := s.budgetedSets(tenant, host.PublicKey)
+	for _, name := range names {
+		b := s.budgets[name]
+		start := height - height%b.Period
+		spent := s.setSpending(name, start, start+b.Period-1)
+		if spent.Add(reservation.Total()).Cmp(b.Allowance) > 0 {
+			return nil, fmt.Errorf("contract would exceed budget of host set %q (%v spent of %v allowed this period)", name, spent, b.Allowance)
+		}
+	}
+	if len(names) == 0 {
+		return func() {}, nil
+	}
+	s.budgetReserved[reservation] = struct{}{}
+	return func() {
+		s.mu.Lock()
+		delete(s.budgetReserved, reservation)
+		s.mu.Unlock()
+	}, nil
+}
+
+func (s *server) handleLedger(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var hostKey hostdb.HostPublicKey
+	if h := req.FormValue("host"); h != "" {
+		hostKey = hostdb.HostPublicKey(h)
+	}
+	parseHeight := func(name string, def types.BlockHeight) (types.BlockHeight, bool) {
+		v := req.FormValue(name)
+		if v == "" {
+			return def, true
+		}
+		h, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Invalid %v: %v", name, err), http.StatusBadRequest)
+			return 0, false
+		}
+		return types.BlockHeight(h), true
+	}
+	min, ok := parseHeight("min", 0)
+	if !ok {
+		return
+	}
+	max, ok := parseHeight("max", ^types.BlockHeight(0))
+	if !ok {
+		return
+	}
+	tenant := req.FormValue("tenant")
+	if t := requestTenant(req); t != "" {
+		tenant = t
+	}
+	setName := req.FormValue("hostset")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var inSet map[hostdb.HostPublicKey]bool
+	if setName != "" {
+		if _, ok := s.hostSets[setName]; !ok || !canAccess(req, s.hostSetOwners[setName]) {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		inSet = make(map[hostdb.HostPublicKey]bool)
+		for _, h := range s.hostSets[setName] {
+			inSet[h] = true
+		}
+	}
+	var entries []LedgerEntry
+	for _, e := range s.ledger {
+		if (hostKey != "" && e.HostKey != hostKey) ||
+			(inSet != nil && (!inSet[e.HostKey] || e.Tenant != s.hostSetOwners[setName])) ||
+			(tenant != "" && e.Tenant != tenant) ||
+			!canAccess(req, e.Tenant) ||
+			e.Height < min || e.Height > max {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Height < entries[j].Height
+	})
+	writeJSON(w, entries)
+}
+
+func (s *server) handleBudget(w http.ResponseWriter, req *http.Request, setName string) {
+	switch req.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		_, ok := s.hostSets[setName]
+		ok = ok && canAccess(req, s.hostSetOwners[setName])
+		budget := s.budgets[setName]
+		s.mu.Unlock()
+		if !ok {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		writeJSON(w, budget)
+
+	case http.MethodPut:
+		var budget Budget
+		if err := json.NewDecoder(req.Body).Decode(&budget); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		if _, ok := s.hostSets[setName]; !ok || !canAccess(req, s.hostSetOwners[setName]) {
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		var before, after interface{}
+		if old, ok := s.budgets[setName]; ok {
+			before = old
+		}
+		if budget.Period != 0 {
+			after = budget
+		}
+		ae := newAuditEntry(req, "budget", setName, s.hostSetOwners[setName], "set budget of host set "+setName, before, after)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			if budget.Period == 0 {
+				return tx.Delete(bucketBudgets, []byte(setName))
+			}
+			return putJSON(tx, bucketBudgets, []byte(setName), budget)
+		})
+		if err == nil {
+			s.budgets[setName] = budget
+			if budget.Period == 0 {
+				delete(s.budgets, setName)
+			}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// loadLedger loads the spending ledger from the store.
+func (s *server) loadLedger(tx Tx) {
+	s.ledger = nil
+	tx.ForEach(bucketLedger, func(key, value []byte) error {
+		var e LedgerEntry
+		if err := json.Unmarshal(value, &e); err != nil {
+			s.log.Warn("skipping corrupt ledger entry", "contractID", fmt.Sprintf("%x", key), "err", err)
+			return nil
+		}
+		s.ledger = append(s.ledger, e)
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.sia.tech/siad/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// Before the introduction of Store, server state was stored as a set of JSON
+// files: one per contract, plus one each for host sets, renew policies, and
+// tenants. These files are imported into the Store the first time the server
+// starts.
+
+// legacyStateFiles returns the paths of any legacy state files in dir.
+func legacyStateFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		switch name := info.Name(); {
+		case filepath.Ext(name) == ".contract",
+			name == "hostSets.json",
+			name == "renewPolicies.json",
+			name == "auth.json":
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return paths, nil
+}
+
+// importLegacyState imports any legacy state files into the store, returning
+// the paths of the files that were imported. Corrupt files are skipped.
+func (s *server) importLegacyState(tx Tx) ([]string, error) {
+	paths, err := legacyStateFiles(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var imported []string
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		switch filepath.Base(path) {
+		case "hostSets.json":
+			var hostSets map[string][]hostdb.HostPublicKey
+			if err := json.Unmarshal(data, &hostSets); err != nil {
+				s.log.Warn("skipping corrupt legacy file", "path", path, "err", err)
+				continue
+			}
+			for name, hosts := range hostSets {
+				if err := putJSON(tx, bucketHostSets, []byte(name), hosts); err != nil {
+					return nil, err
+				}
+			}
+
+		case "renewPolicies.json":
+			var policies map[string]RenewPolicy
+			if err := json.Unmarshal(data, &policies); err != nil {
+				s.log.Warn("skipping corrupt legacy file", "path", path, "err", err)
+				continue
+			}
+			for name, policy := range policies {
+				if err := putJSON(tx, bucketRenewPolicies, []byte(name), policy); err != nil {
+					return nil, err
+				}
+			}
+
+		case "auth.json":
+			var auth struct {
+				Tenants       map[string]crypto.Hash `json:"tenants"`
+				HostSetOwners map[string]string      `json:"hostSetOwners"`
+			}
+			if err := json.Unmarshal(data, &auth); err != nil {
+				s.log.Warn("skipping corrupt legacy file", "path", path, "err", err)
+				continue
+			}
+			for name, h := range auth.Tenants {
+				if err := tx.Put(bucketTenants, []byte(name), h[:]); err != nil {
+					return nil, err
+				}
+			}
+			for name, owner := range auth.HostSetOwners {
+				if err := tx.Put(bucketHostSetOwners, []byte(name), []byte(owner)); err != nil {
+					return nil, err
+				}
+			}
+
+		default: // contract
+			js, _, err := s.unseal(data)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", path, err)
+			}
+			var c Contract
+			if err := json.Unmarshal(js, &c); err != nil {
+				s.log.Warn("skipping corrupt legacy file", "path", path, "err", err)
+				continue
+			}
+			if err := s.putContract(tx, c); err != nil {
+				return nil, err
+			}
+		}
+		imported = append(imported, path)
+	}
+	if len(imported) > 0 {
+		s.log.Info("imported legacy state files", "count", len(imported))
+	}
+	return imported, nil
+}
+
+// cleanupLegacyStateFiles cleans up any legacy state files after the store
+// transaction that imported them has committed. Imported contract files
+// contain plaintext renter keys, so they are deleted. All other files,
+// including any that were skipped during the import, are moved into a
+// subdirectory, so that they can be deleted once the operator is satisfied
+// that they were imported correctly.
+func cleanupLegacyStateFiles(dir string, imported []string, log *Logger) error {
+	paths, err := legacyStateFiles(dir)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	remove := make(map[string]bool, len(imported))
+	for _, path := range imported {
+		remove[path] = filepath.Ext(path) == ".contract"
+	}
+	legacyDir := filepath.Join(dir, "legacy")
+	var removed, kept int
+	for _, path := range paths {
+		if remove[path] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+			continue
+		}
+		if err := os.MkdirAll(legacyDir, 0770); err != nil {
+			return err
+		}
+		if err := os.Rename(path, filepath.Join(legacyDir, filepath.Base(path))); err != nil {
+			return err
+		}
+		kept++
+	}
+	if removed > 0 {
+		log.Info("removed imported legacy contract files", "count", removed)
+	}
+	if kept > 0 {
+		log.Info("moved legacy state files", "count", kept, "dir", legacyDir)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package muse
+
+import (
+	"net/http"
+	"strings"
+
+	"go.sia.tech/siad/types"
+)
+
+// lineage returns every contract in the renewal chain containing the specified
+// contract, ordered from oldest to newest. Archived contracts are included, so
+// that the chain remains complete after its older members expire. The caller
+// must hold s.mu.
+func (s *server) lineage(id types.FileContractID) []Contract {
+	byID := make(map[types.FileContractID]Contract, len(s.contracts)+len(s.archive))
+	for _, c := range s.archive {
+		byID[c.ID] = c
+	}
+	for _, c := range s.contracts {
+		byID[c.ID] = c
+	}
+	c, ok := byID[id]
+	if !ok {
+		return nil
+	}
+	// walk backwards to the original contract, then forwards to the latest
+	// renewal; the seen map guards against cycles in corrupt metadata
+	seen := map[types.FileContractID]bool{c.ID: true}
+	for {
+		prev, ok := byID[c.RenewedFrom]
+		if !ok || seen[prev.ID] {
+			break
+		}
+		seen[prev.ID] = true
+		c = prev
+	}
+	chain := []Contract{c}
+	seen = map[types.FileContractID]bool{c.ID: true}
+	for {
+		next, ok := byID[c.RenewedTo]
+		if !ok || seen[next.ID] {
+			break
+		}
+		seen[next.ID] = true
+		chain = append(chain, next)
+		c = next
+	}
+	return chain
+}
+
+func (s *server) handleLineage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	idStr := strings.TrimPrefix(req.URL.Path, "/lineage/")
+	if strings.Contains(idStr, "/") {
+		writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	var id types.FileContractID
+	if err := id.LoadString(idStr); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	chain := s.lineage(id)
+	s.mu.Unlock()
+	if len(chain) == 0 || !canAccess(req, chain[0].Tenant) {
+		writeErrorKind(w, "no record of that contract", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	}
+	writeJSON(w, responseContracts(chain))
+}
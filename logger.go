@@ -0,0 +1,207 @@
+package muse
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"lukechampine.com/frand"
+)
+
+// A LogLevel indicates the severity of a log event.
+type LogLevel int
+
+// Log levels, in increasing order of severity.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String implements fmt.Stringer.
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// A LogFormat specifies how a Logger encodes events.
+type LogFormat int
+
+// Supported log formats.
+const (
+	// LogfmtFormat encodes each event as a line of space-separated key=value
+	// pairs.
+	LogfmtFormat LogFormat = iota
+	// JSONFormat encodes each event as a JSON object.
+	JSONFormat
+)
+
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format LogFormat
+	level  LogLevel
+}
+
+// A Logger writes structured, leveled log events. Each event consists of a
+// message and a set of fields, specified as alternating keys and values.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// NewLogger returns a Logger that writes events at or above the specified
+// level to w, using the specified format.
+func NewLogger(w io.Writer, format LogFormat, level LogLevel) *Logger {
+	return &Logger{out: &logOutput{w: w, format: format, level: level}}
+}
+
+// With returns a Logger that adds the supplied fields to every event.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{
+		out:    l.out,
+		fields: append(append([]interface{}(nil), l.fields...), fields...),
+	}
+}
+
+// Debug logs an event at LevelDebug.
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+
+// Info logs an event at LevelInfo.
+func (l *Logger) Info(msg string, fields ...interface{}) { l.log(LevelInfo, msg, fields) }
+
+// Warn logs an event at LevelWarn.
+func (l *Logger) Warn(msg string, fields ...interface{}) { l.log(LevelWarn, msg, fields) }
+
+// Error logs an event at LevelError.
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level LogLevel, msg string, fields []interface{}) {
+	if level < l.out.level {
+		return
+	}
+	kvs := []interface{}{"time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}
+	kvs = append(kvs, l.fields...)
+	kvs = append(kvs, fields...)
+	if len(kvs)%2 != 0 {
+		kvs = append(kvs, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	switch l.out.format {
+	case JSONFormat:
+		buf.WriteByte('{')
+		for i := 0; i < len(kvs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(fmt.Sprint(kvs[i]))
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(jsonLogValue(kvs[i+1]))
+		}
+		buf.WriteString("}\n")
+	default:
+		for i := 0; i < len(kvs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fmt.Sprint(kvs[i]))
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(kvs[i+1]))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+func jsonLogValue(v interface{}) []byte {
+	if err, ok := v.(error); ok {
+		v = errorString(err)
+	} else if s, ok := v.(fmt.Stringer); ok {
+		v = s.String()
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		js, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return js
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	if err, ok := v.(error); ok {
+		s = errorString(err)
+	} else {
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, needsQuote) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// needsQuote reports whether a logfmt value containing r must be quoted.
+// Quoting escapes control characters and invalid UTF-8, so that values cannot
+// forge additional log lines.
+func needsQuote(r rune) bool {
+	return r == '=' || r == '"' || r == utf8.RuneError || unicode.IsSpace(r) || !unicode.IsPrint(r)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
+
+// WithLogger causes the server to write log events to the supplied Logger,
+// rather than writing them to stderr in logfmt format.
+func WithLogger(l *Logger) ServerOption {
+	return func(s *server) {
+		s.log = l
+	}
+}
+
+type requestIDKey struct{}
+
+// withRequestID assigns an ID to the request, reusing the X-Request-ID header
+// if the client supplied one, and echoes it in the response headers.
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 64 || strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 {
+		id = hex.EncodeToString(frand.Bytes(8))
+	}
+	w.Header().Set("X-Request-ID", id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+// reqLog returns a Logger that includes the request's ID in every event.
+func (s *server) reqLog(req *http.Request) *Logger {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return s.log.With("requestID", id)
+}
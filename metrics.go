@@ -0,0 +1,191 @@
+package muse
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// metrics are exposed at /metrics in the Prometheus text format.
+type metrics struct {
+	mu                sync.Mutex
+	ops               map[string]*opStats
+	resolveErrors     uint64
+	resolveCacheHits  uint64
+	tpoolRejections   uint64
+	scanCacheHits     uint64
+	autoRenewFailures uint64
+}
+
+type opStats struct {
+	calls    uint64
+	failures uint64
+	seconds  float64
+}
+
+// observe records a call to the specified operation.
+func (m *metrics) observe(op string, start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = make(map[string]*opStats)
+	}
+	s, ok := m.ops[op]
+	if !ok {
+		s = new(opStats)
+		m.ops[op] = s
+	}
+	s.calls++
+	s.seconds += time.Since(start).Seconds()
+	if err != nil {
+		s.failures++
+	}
+}
+
+// inc increments a counter.
+func (m *metrics) inc(counter *uint64) {
+	m.mu.Lock()
+	*counter++
+	m.mu.Unlock()
+}
+
+// resolveHostKey resolves a host's address via shard, counting failures.
+func (s *server) resolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	addr, err := s.shard.ResolveHostKey(hostKey)
+	if err != nil {
+		s.metrics.inc(&s.metrics.resolveErrors)
+	}
+	return addr, err
+}
+
+// acceptTransactionSet submits txnSet to the transaction pool, logging (and
+// counting) rejections.
+func (s *server) acceptTransactionSet(log *Logger, txnSet []types.Transaction) {
+	err := s.tpool.AcceptTransactionSet(txnSet)
+	if err != nil && err != modules.ErrDuplicateTransactionSet {
+		s.metrics.inc(&s.metrics.tpoolRejections)
+		log.Warn("contract transaction was not accepted", "err", err)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label formats a Prometheus label.
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func currencyFloat(c types.Currency) float64 {
+	f, _ := c.Float64()
+	return f
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	} else if requestTenant(req) != "" {
+		writeError(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// the chain height is needed to determine which contracts have expired
+	height, heightErr := s.shard.ChainHeight()
+
+	// render the metrics into a buffer while holding the locks, and only
+	// write them once the locks are released, so that a slow client cannot
+	// stall the server
+	var buf bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name, labels string, v float64) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(&buf, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+
+	s.metrics.mu.Lock()
+	opNames := make([]string, 0, len(s.metrics.ops))
+	for op := range s.metrics.ops {
+		opNames = append(opNames, op)
+	}
+	sort.Strings(opNames)
+	metric("muse_operations_total", "counter", "Number of form, renew, and scan calls.")
+	for _, op := range opNames {
+		sample("muse_operations_total", label("op", op), float64(s.metrics.ops[op].calls))
+	}
+	metric("muse_operation_failures_total", "counter", "Number of failed form, renew, and scan calls.")
+	for _, op := range opNames {
+		sample("muse_operation_failures_total", label("op", op), float64(s.metrics.ops[op].failures))
+	}
+	metric("muse_operation_duration_seconds", "summary", "Duration of form, renew, and scan calls.")
+	for _, op := range opNames {
+		sample("muse_operation_duration_seconds_sum", label("op", op), s.metrics.ops[op].seconds)
+		sample("muse_operation_duration_seconds_count", label("op", op), float64(s.metrics.ops[op].calls))
+	}
+	metric("muse_scan_cache_hits_total", "counter", "Number of scans served from the cache.")
+	sample("muse_scan_cache_hits_total", "", float64(s.metrics.scanCacheHits))
+	metric("muse_shard_resolution_errors_total", "counter", "Number of failed host address lookups.")
+	sample("muse_shard_resolution_errors_total", "", float64(s.metrics.resolveErrors))
+	metric("muse_shard_resolution_cache_hits_total", "counter", "Number of host address lookups served from the cache.")
+	sample("muse_shard_resolution_cache_hits_total", "", float64(s.metrics.resolveCacheHits))
+	metric("muse_tpool_rejections_total", "counter", "Number of contract transaction sets rejected by the transaction pool.")
+	sample("muse_tpool_rejections_total", "", float64(s.metrics.tpoolRejections))
+	metric("muse_autorenew_failures_total", "counter", "Number of failed automatic renewals.")
+	sample("muse_autorenew_failures_total", "", float64(s.metrics.autoRenewFailures))
+	s.metrics.mu.Unlock()
+
+	s.mu.Lock()
+	setNames := make([]string, 0, len(s.hostSets))
+	for name := range s.hostSets {
+		setNames = append(setNames, name)
+	}
+	sort.Strings(setNames)
+	if heightErr == nil {
+		metric("muse_chain_height", "gauge", "Current block height, as reported by shard.")
+		sample("muse_chain_height", "", float64(height))
+		metric("muse_hostset_contracts", "gauge", "Number of active and expired contracts in each host set.")
+		for _, name := range setNames {
+			var active, expired int
+			contracts, _ := s.activeContracts(name)
+			for _, c := range contracts {
+				if isActive(c, height) {
+					active++
+				} else {
+					expired++
+				}
+			}
+			sample("muse_hostset_contracts", label("hostset", name)+`,state="active"`, float64(active))
+			sample("muse_hostset_contracts", label("hostset", name)+`,state="expired"`, float64(expired))
+		}
+	}
+	metric("muse_contracts", "gauge", "Number of contracts stored by the server.")
+	sample("muse_contracts", "", float64(len(s.contracts)))
+
+	var funds, hostFees, taxes, txnFees types.Currency
+	for _, e := range s.ledger {
+		funds = funds.Add(e.Funds)
+		hostFees = hostFees.Add(e.HostFee)
+		taxes = taxes.Add(e.SiafundTax)
+		txnFees = txnFees.Add(e.TxnFee)
+	}
+	metric("muse_spent_hastings_total", "counter", "Siacoins spent forming and renewing contracts, in hastings.")
+	sample("muse_spent_hastings_total", `kind="funds"`, currencyFloat(funds))
+	sample("muse_spent_hastings_total", `kind="host_fee"`, currencyFloat(hostFees))
+	sample("muse_spent_hastings_total", `kind="siafund_tax"`, currencyFloat(taxes))
+	sample("muse_spent_hastings_total", `kind="txn_fee"`, currencyFloat(txnFees))
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
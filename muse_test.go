@@ -1,14 +1,22 @@
 package muse
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/encoding"
@@ -19,6 +27,7 @@ import (
 	"lukechampine.com/shard"
 	"lukechampine.com/us/ed25519hash"
 	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renterhost"
 )
 
@@ -55,130 +64,2169 @@ func (stubWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash)
 	return nil
 }
 
+// spendWallet is a stubWallet that records how much it has been asked to fund.
+type spendWallet struct {
+	stubWallet
+	mu    sync.Mutex
+	spent types.Currency
+}
+
+func (w *spendWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.spent = w.spent.Add(amount)
+	return w.stubWallet.FundTransaction(txn, amount)
+}
+
 type stubTpool struct{}
 
-func (stubTpool) AcceptTransactionSet([]types.Transaction) (_ error)                    { return }
-func (stubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
-func (stubTpool) FeeEstimate() (_, _ types.Currency, _ error)                           { return }
+func (stubTpool) AcceptTransactionSet([]types.Transaction) (_ error)                    { return }
+func (stubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
+func (stubTpool) FeeEstimate() (_, _ types.Currency, _ error)                           { return }
+
+func startSHARD(hpk hostdb.HostPublicKey, ann []byte) (string, func() error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return "", nil
+	}
+	p := &memPersist{
+		PersistData: shard.PersistData{
+			Hosts: map[hostdb.HostPublicKey][]byte{hpk: ann},
+		},
+	}
+	r, err := shard.NewRelay(mockCS{}, p)
+	if err != nil {
+		return "", nil
+	}
+	srv := shard.NewServer(r)
+	go http.Serve(l, srv)
+	return "http://" + l.Addr().String(), l.Close
+}
+
+func TestServer(t *testing.T) {
+	// create a host
+	host, err := newHost(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	// create a shard server
+	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+	defer stop()
+
+	// create the muse server
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, shardAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, srv)
+
+	// test contract formation
+	c := NewClient("http://" + l.Addr().String())
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal(err)
+	}
+
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+1, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != contract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	// test contract renewal
+	newContract, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+3, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a contract can only be renewed once
+	if _, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+4, settings); err == nil || !strings.Contains(err.Error(), "already been renewed") {
+		t.Fatal("expected renewal of renewed contract to fail, got", err)
+	}
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 2 || contracts[1].ID != newContract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+
+	// test host sets
+	if err = c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if sets, err := c.HostSets(); err != nil {
+		t.Fatal(err)
+	} else if len(sets) != 1 || sets[0] != "foo" {
+		t.Fatal("wrong host sets:", sets)
+	}
+	if set, err := c.HostSet("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(set) != 1 || set[0] != host.PublicKey() {
+		t.Fatal("wrong host set:", set)
+	}
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != newContract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+
+	// test lineage; a renewal with an earlier end height should still be
+	// considered the active contract
+	latestContract, err := c.Renew(newContract.ID, types.ZeroCurrency, currentHeight, currentHeight+2, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != latestContract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	if chain, err := c.Lineage(newContract.ID); err != nil {
+		t.Fatal(err)
+	} else if len(chain) != 3 || chain[0].ID != contract.ID || chain[1].ID != newContract.ID || chain[2].ID != latestContract.ID {
+		t.Fatal("wrong lineage:", chain)
+	} else if chain[1].RenewedFrom != contract.ID || chain[1].RenewedTo != latestContract.ID {
+		t.Fatal("wrong lineage links:", chain[1])
+	}
+
+	// test deletion
+	if err := c.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 2 || contracts[0].ID != newContract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	// archived contracts should remain in the lineage
+	for _, id := range []types.FileContractID{contract.ID, latestContract.ID} {
+		if chain, err := c.Lineage(id); err != nil {
+			t.Fatal(err)
+		} else if len(chain) != 3 || chain[0].ID != contract.ID || chain[2].ID != latestContract.ID {
+			t.Fatal("wrong lineage after archival:", chain)
+		}
+	}
+
+	// test context cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := c.WithContext(ctx).AllContracts(); err != nil {
+		t.Fatal("should not fail with uncancelled context:", err)
+	}
+	cancel()
+	if _, err := c.WithContext(ctx).AllContracts(); err == nil {
+		t.Fatal("should fail with cancelled context")
+	}
+}
+
+// newTestServer creates a host, a shard server that knows about the host, and
+// a muse server, returning the muse server, a client connected to it, and a
+// function that shuts everything down.
+func newTestServer(t *testing.T, opts ...ServerOption) (*server, *Client, *Host, func()) {
+	t.Helper()
+	host, err := newHost(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardAddr, stopSHARD := startSHARD(host.PublicKey(), host.announcement())
+	dir, _ := ioutil.TempDir("", t.Name())
+	srv, err := newServer(dir, stubWallet{}, stubTpool{}, shardAddr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, srv)
+	stop := func() {
+		l.Close()
+		os.RemoveAll(dir)
+		stopSHARD()
+		host.Close()
+	}
+	return srv, NewClient("http://" + l.Addr().String()), host, stop
+}
+
+// newTestServerHosts is like newTestServer, but creates n hosts, all known to
+// shard.
+func newTestServerHosts(t *testing.T, n int, opts ...ServerOption) (*server, *Client, []*Host, func()) {
+	t.Helper()
+	hosts := make([]*Host, n)
+	announcements := make(map[hostdb.HostPublicKey][]byte)
+	for i := range hosts {
+		h, err := newHost(":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts[i] = h
+		announcements[h.PublicKey()] = h.announcement()
+	}
+	sl, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := shard.NewRelay(mockCS{}, &memPersist{PersistData: shard.PersistData{Hosts: announcements}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(sl, shard.NewServer(relay))
+	dir, _ := ioutil.TempDir("", t.Name())
+	srv, err := newServer(dir, stubWallet{}, stubTpool{}, "http://"+sl.Addr().String(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, srv)
+	stop := func() {
+		l.Close()
+		os.RemoveAll(dir)
+		sl.Close()
+		for _, h := range hosts {
+			h.Close()
+		}
+	}
+	return srv, NewClient("http://" + l.Addr().String()), hosts, stop
+}
+
+func TestAutoRenew(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// policy must have a duration longer than its window
+	if err := c.SetRenewPolicy("foo", RenewPolicy{Window: 10, Duration: 5}); err == nil {
+		t.Fatal("expected invalid policy to be rejected")
+	}
+	if err := c.SetRenewPolicy("nonexistent", RenewPolicy{Window: 5, Duration: 20}); err == nil {
+		t.Fatal("expected policy for unknown host set to be rejected")
+	}
+	policy := RenewPolicy{Window: 5, Duration: 20}
+	if err := c.SetRenewPolicy("foo", policy); err != nil {
+		t.Fatal(err)
+	} else if p, err := c.RenewPolicy("foo"); err != nil {
+		t.Fatal(err)
+	} else if p.Window != policy.Window || p.Duration != policy.Duration {
+		t.Fatal("wrong policy:", p)
+	}
+
+	// contract is outside the renew window; nothing should happen
+	srv.autoRenew(currentHeight)
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != contract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+
+	// advance into the renew window
+	srv.autoRenew(currentHeight + 6)
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID == contract.ID || contracts[0].EndHeight != currentHeight+6+policy.Duration {
+		t.Fatal("contract was not renewed:", contracts)
+	}
+
+	// expired contracts should not be renewed
+	srv.autoRenew(currentHeight + 6 + policy.Duration)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 2 {
+		t.Fatal("expired contract should not have been renewed:", contracts)
+	}
+
+	// disable the policy
+	if err := c.SetRenewPolicy("foo", RenewPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	srv.autoRenew(currentHeight + 100)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 2 {
+		t.Fatal("contract should not have been renewed:", contracts)
+	}
+
+	// a failing renewal should only be reported once, even though it is
+	// retried
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Watch(ctx, EventRenewFailed, EventHostSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent := func() Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+	contract, err = c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight+100, currentHeight+110, settings)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := c.SetRenewPolicy("foo", policy); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetPriceLimits("foo", PriceLimits{MaxWindowSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	srv.autoRenew(currentHeight + 106)
+	if ev := nextEvent(); ev.Type != EventRenewFailed || ev.Contract.ID != contract.ID {
+		t.Fatal("wrong event:", ev)
+	}
+	srv.autoRenew(currentHeight + 107)
+	if err := c.SetHostSet("bar", nil); err != nil {
+		t.Fatal(err)
+	} else if ev := nextEvent(); ev.Type != EventHostSet {
+		t.Fatal("renewal failure should not be reported twice:", ev)
+	}
+
+	// the renew loop should exit when the server's context is done
+	loopCtx, loopCancel := context.WithCancel(context.Background())
+	srv.ctx = loopCtx
+	done := make(chan struct{})
+	go func() {
+		srv.autoRenewLoop()
+		close(done)
+	}()
+	loopCancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renew loop did not exit")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	funds := types.NewCurrency64(100)
+	contract, err := c.Form(host.PublicKey(), funds, currentHeight, currentHeight+50, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshing keeps the end height
+	refreshed, err := c.Refresh(contract.ID, types.NewCurrency64(150), currentHeight+1)
+	if err != nil {
+		t.Fatal(err)
+	} else if refreshed.RenewedFrom != contract.ID || refreshed.EndHeight != contract.EndHeight {
+		t.Fatal("wrong refreshed contract:", refreshed)
+	}
+	if entries, err := c.Ledger(LedgerQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[1].ContractID != refreshed.ID || !entries[1].Funds.Equals64(150) {
+		t.Fatal("wrong ledger:", entries)
+	}
+	if _, err := c.Refresh(contract.ID, funds, currentHeight+1); err == nil {
+		t.Fatal("expected refresh of renewed contract to fail")
+	}
+	if _, err := c.Refresh(refreshed.ID, funds, currentHeight+50); err == nil {
+		t.Fatal("expected refresh of expired contract to fail")
+	}
+
+	// automatically refresh contracts whose funds fall below the threshold
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	policy := RenewPolicy{Window: 5, Duration: 20, Funds: types.NewCurrency64(300), RefreshThreshold: types.NewCurrency64(300)}
+	if err := c.SetRenewPolicy("foo", policy); err == nil {
+		t.Fatal("expected policy with funds below refresh threshold to be rejected")
+	}
+	policy.RefreshThreshold = types.NewCurrency64(200)
+	if err := c.SetRenewPolicy("foo", policy); err != nil {
+		t.Fatal(err)
+	}
+	srv.autoRefresh(currentHeight + 2)
+	contracts, err := c.Contracts("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].RenewedFrom != refreshed.ID || contracts[0].EndHeight != contract.EndHeight {
+		t.Fatal("contract was not refreshed:", contracts)
+	}
+	if entries, err := c.Audit(AuditQuery{Action: "renew"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[1].Caller != "autorefresh" {
+		t.Fatal("wrong audit log:", entries)
+	}
+
+	// the refreshed contract has enough funds
+	srv.autoRefresh(currentHeight + 3)
+	if cs, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 1 || cs[0].ID != contracts[0].ID {
+		t.Fatal("contract should not have been refreshed:", cs)
+	} else if !cs[0].RenterFunds.Equals(policy.Funds) {
+		t.Fatal("revision was not fetched:", cs[0])
+	}
+}
+
+func TestBudget(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	budget := Budget{Allowance: types.NewCurrency64(150), Period: 100}
+	if err := c.SetBudget("foo", budget); err != nil {
+		t.Fatal(err)
+	} else if b, err := c.Budget("foo"); err != nil {
+		t.Fatal(err)
+	} else if !b.Allowance.Equals(budget.Allowance) || b.Period != budget.Period {
+		t.Fatal("wrong budget:", b)
+	}
+
+	// the first contract fits within the budget; the second does not
+	funds := types.NewCurrency64(100)
+	contract, err := c.Form(host.PublicKey(), funds, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Form(host.PublicKey(), funds, currentHeight, currentHeight+10, settings); err == nil {
+		t.Fatal("expected formation to exceed budget")
+	}
+	// the budget period is determined by the chain height, not the requested
+	// start height
+	if _, err := c.Form(host.PublicKey(), funds, currentHeight+1000, currentHeight+1010, settings); err == nil {
+		t.Fatal("expected formation in a future period to exceed budget")
+	}
+	if _, err := c.Renew(contract.ID, funds, currentHeight, currentHeight+20, settings); err == nil {
+		t.Fatal("expected renewal to exceed budget")
+	}
+
+	// the ledger should contain a single entry
+	entries, err := c.Ledger(LedgerQuery{HostSet: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].ContractID != contract.ID || entries[0].Type != "form" || !entries[0].Funds.Equals(funds) || entries[0].Height != currentHeight {
+		t.Fatal("wrong ledger:", entries)
+	}
+	if entries, err := c.Ledger(LedgerQuery{MinHeight: currentHeight + 1}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatal("wrong ledger:", entries)
+	}
+
+	// removing the budget allows further spending
+	if err := c.SetBudget("foo", Budget{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Renew(contract.ID, funds, currentHeight, currentHeight+20, settings); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := c.Ledger(LedgerQuery{HostKey: host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[1].Type != "renew" {
+		t.Fatal("wrong ledger:", entries)
+	}
+}
+
+func TestLedgerCost(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	w := new(spendWallet)
+	srv.wallet = w
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.ContractPrice = types.NewCurrency64(1000)
+	settings.StoragePrice = types.NewCurrency64(10)
+	settings.UploadBandwidthPrice = types.NewCurrency64(3)
+	settings.Collateral = types.NewCurrency64(20)
+	settings.MaxCollateral = types.SiacoinPrecision
+	scanned := hostdb.ScannedHost{HostSettings: settings, PublicKey: host.PublicKey()}
+	spent := func() types.Currency {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		s := w.spent
+		w.spent = types.ZeroCurrency
+		return s
+	}
+
+	// the recorded cost of a formation should match both the wallet's spend
+	// and the estimate used to reserve budgets
+	funds := types.NewCurrency64(1e9)
+	contract, err := c.Form(host.PublicKey(), funds, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.Ledger(LedgerQuery{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || !entries[0].Total().Equals(spent()) {
+		t.Fatal("recorded formation cost does not match wallet spend:", entries)
+	} else if est := estimateCost(scanned, nil, funds, currentHeight, currentHeight+10, currentHeight); !est.Total().Equals(entries[0].Total()) {
+		t.Fatalf("estimated formation cost %v does not match recorded cost %v", est.Total(), entries[0].Total())
+	}
+
+	// store some data in the contract, so that renewing it incurs a base price
+	host.setFileSize(contract.ID, contract.RenterKey, 1<<20)
+	srv.updateRevisions(currentHeight)
+	var old Contract
+	for _, old = range srv.contracts {
+		if old.ID == contract.ID {
+			break
+		}
+	}
+	if old.NewFileSize != 1<<20 {
+		t.Fatal("wrong file size:", old.NewFileSize)
+	}
+	if _, err := c.Renew(contract.ID, funds, currentHeight, currentHeight+20, settings); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = c.Ledger(LedgerQuery{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || !entries[1].Total().Equals(spent()) {
+		t.Fatal("recorded renewal cost does not match wallet spend:", entries)
+	} else if basePrice := settings.StoragePrice.Mul64(1 << 20).Mul64(10); !entries[1].HostFee.Equals(settings.ContractPrice.Add(basePrice)) {
+		t.Fatal("renewal host fee should include base price:", entries[1].HostFee)
+	} else if est := estimateCost(scanned, &old, funds, currentHeight, currentHeight+20, currentHeight); !est.Total().Equals(entries[1].Total()) {
+		t.Fatalf("estimated renewal cost %v does not match recorded cost %v", est.Total(), entries[1].Total())
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	var buf bytes.Buffer
+	srv, c, host, stop := newTestServer(t, WithLogger(NewLogger(&buf, JSONFormat, LevelInfo)))
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	funds := types.NewCurrency64(100)
+	contract, err := c.Form(host.PublicKey(), funds, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if !contracts[0].LastSeen.IsZero() {
+		t.Fatal("revision should not have been fetched yet")
+	}
+
+	srv.updateRevisions(currentHeight)
+	contracts, err := c.AllContracts()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != contract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	if c := contracts[0]; c.LastSeen.IsZero() || c.RevisionNumber != 1 || !c.RenterFunds.Equals(funds) || c.NewFileSize != 0 {
+		t.Fatal("wrong revision metadata:", c)
+	}
+
+	// recently-fetched contracts should be ignored
+	lastSeen := contracts[0].LastSeen
+	srv.updateRevisions(currentHeight)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if !contracts[0].LastSeen.Equal(lastSeen) {
+		t.Fatal("recently-fetched contract should not have been updated")
+	}
+
+	// expired contracts should be ignored
+	srv.mu.Lock()
+	srv.contracts[0].LastSeen = lastSeen.Add(-revisionMaxAge)
+	lastSeen = srv.contracts[0].LastSeen
+	srv.mu.Unlock()
+	srv.updateRevisions(currentHeight + 10)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if !contracts[0].LastSeen.Equal(lastSeen) {
+		t.Fatal("expired contract should not have been updated")
+	}
+
+	// locked contracts should be skipped without a warning
+	host.contracts[contract.ID].locked = true
+	srv.updateRevisions(currentHeight)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if !contracts[0].LastSeen.Equal(lastSeen) {
+		t.Fatal("locked contract should not have been updated")
+	} else if strings.Contains(buf.String(), "could not fetch contract revision") {
+		t.Fatal("locked contract should not be logged as a failure:", buf.String())
+	}
+}
+
+func TestHostMonitor(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.HostInfo(host.PublicKey()); err == nil {
+		t.Fatal("expected unscanned host to be unknown")
+	}
+
+	srv.monitorHosts()
+	info, err := c.HostInfo(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if info.TotalScans != 1 || info.SuccessfulScans != 1 || len(info.SettingsHistory) != 1 || info.Settings.NetAddress != host.addr {
+		t.Fatal("wrong host info:", info)
+	}
+
+	// scanning should use the cache unless forced
+	if _, err := c.Scan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if info, err := c.HostInfo(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if info.TotalScans != 1 {
+		t.Fatal("scan should have been served from cache:", info)
+	}
+	if _, err := c.ForceScan(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if info, err := c.HostInfo(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if info.TotalScans != 2 || len(info.SettingsHistory) != 1 {
+		t.Fatal("wrong host info:", info)
+	}
+
+	// failed scans should be recorded
+	host.Close()
+	srv.monitorHosts()
+	if hosts, err := c.Hosts(); err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0].TotalScans != 3 || hosts[0].SuccessfulScans != 2 || hosts[0].LastError == "" {
+		t.Fatal("wrong host info:", hosts)
+	} else if uptime := hosts[0].Uptime(); uptime < 0.66 || uptime > 0.67 {
+		t.Fatal("wrong uptime:", uptime)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.ForceScan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Scan("ed25519:0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("expected scan of unknown host to fail")
+	}
+
+	resp, err := http.Get(c.addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`muse_operations_total{op="form"} 1`,
+		`muse_operations_total{op="scan"} 1`,
+		`muse_operation_failures_total{op="form"} 0`,
+		`muse_shard_resolution_errors_total 1`,
+		`muse_hostset_contracts{hostset="foo",state="active"} 1`,
+		`muse_hostset_contracts{hostset="foo",state="expired"} 0`,
+		`muse_contracts 1`,
+	} {
+		if !bytes.Contains(body, []byte(line+"\n")) {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	_, c, host, stop := newTestServer(t, WithLogger(NewLogger(&buf, JSONFormat, LevelInfo)))
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// supplied request IDs should be echoed and logged
+	req, _ := http.NewRequest(http.MethodPost, c.addr+"/delete/"+contract.ID.String(), nil)
+	req.Header.Set("X-Request-ID", "foo")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-ID"); id != "foo" {
+		t.Fatalf("wrong request ID %q", id)
+	}
+
+	var events []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	var formed, deleted bool
+	for _, e := range events {
+		switch e["msg"] {
+		case "formed contract":
+			formed = e["contractID"] == contract.ID.String() && e["hostKey"] == string(host.PublicKey()) && e["requestID"] != ""
+		case "deleted contract":
+			deleted = e["contractID"] == contract.ID.String() && e["requestID"] == "foo"
+		}
+	}
+	if !formed || !deleted {
+		t.Fatal("missing lifecycle events:", events)
+	}
+
+	// request IDs containing control characters should be replaced
+	req = httptest.NewRequest(http.MethodGet, "/contracts", nil)
+	req.Header.Set("X-Request-ID", "foo\rlevel=error msg=forged")
+	rec := httptest.NewRecorder()
+	req = withRequestID(rec, req)
+	if id := rec.Header().Get("X-Request-ID"); strings.ContainsAny(id, "\r ") || len(id) != 16 {
+		t.Fatalf("unsafe request ID %q was not replaced", id)
+	}
+	// logfmt values containing control characters should be quoted
+	for _, v := range []string{"foo\rbar", "foo\x00", "foo\u2028bar", "\xff"} {
+		if q := logfmtValue(v); q != strconv.Quote(v) {
+			t.Errorf("value %q was not quoted: %s", v, q)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rolled-back transaction should not consume a sequence number
+	srv.mu.Lock()
+	err = srv.store.Update(func(tx Tx) error {
+		if err := srv.putAudit(tx, AuditEntry{Action: "form"}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	srv.mu.Unlock()
+	if err == nil {
+		t.Fatal("expected transaction to fail")
+	}
+	newContract, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHostSet("foo", nil); err != nil {
+		t.Fatal(err)
+	} else if err := c.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.Audit(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []struct {
+		action, target string
+	}{
+		{"form", contract.ID.String()},
+		{"renew", contract.ID.String()},
+		{"hostset", "foo"},
+		{"hostset", "foo"},
+		{"delete", contract.ID.String()},
+	}
+	if len(entries) != len(exp) {
+		t.Fatal("wrong number of audit entries:", entries)
+	}
+	for i, e := range entries {
+		if e.Seq != uint64(i+1) || e.Action != exp[i].action || e.Target != exp[i].target || e.Caller != "admin" {
+			t.Fatalf("wrong audit entry %v: %+v", i, e)
+		}
+	}
+	// the renewal should record the new contract
+	var after struct {
+		ID types.FileContractID `json:"id"`
+	}
+	if err := json.Unmarshal(entries[1].After, &after); err != nil {
+		t.Fatal(err)
+	} else if after.ID != newContract.ID {
+		t.Fatal("wrong renewal state:", string(entries[1].After))
+	}
+	// deleting the host set should record its previous contents
+	var before []hostdb.HostPublicKey
+	if err := json.Unmarshal(entries[3].Before, &before); err != nil {
+		t.Fatal(err)
+	} else if len(before) != 1 || before[0] != host.PublicKey() || len(entries[3].After) != 0 {
+		t.Fatal("wrong host set state:", entries[3])
+	}
+	// renter keys must not be recorded
+	for _, e := range entries {
+		if bytes.Contains(e.Before, []byte("renterKey")) || bytes.Contains(e.After, []byte("renterKey")) {
+			t.Fatal("audit entry contains renter key:", e)
+		}
+	}
+
+	// test filtering
+	if entries, err := c.Audit(AuditQuery{Action: "hostset"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatal("wrong audit entries:", entries)
+	}
+	if entries, err := c.Audit(AuditQuery{Target: contract.ID.String(), After: 1, Limit: 1}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Action != "renew" {
+		t.Fatal("wrong audit entries:", entries)
+	}
+
+	// test paging backwards from the most recent entry
+	n := len(exp)
+	if entries, err := c.Audit(AuditQuery{Reverse: true, Limit: 2}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[0].Seq != uint64(n) || entries[1].Seq != uint64(n-1) {
+		t.Fatal("wrong audit entries:", entries)
+	}
+	if entries, err := c.Audit(AuditQuery{Reverse: true, Before: uint64(n - 1)}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != n-2 || entries[0].Seq != uint64(n-2) || entries[len(entries)-1].Seq != 1 {
+		t.Fatal("wrong audit entries:", entries)
+	}
+	if entries, err := c.Audit(AuditQuery{After: 1, Before: 3}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Seq != 2 {
+		t.Fatal("wrong audit entries:", entries)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting should move the contract into the archive
+	if err := c.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("wrong contracts:", contracts)
+	} else if archived, err := c.ArchivedContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(archived) != 1 || archived[0].ID != contract.ID || len(archived[0].RenterKey) == 0 {
+		t.Fatal("wrong archived contracts:", archived)
+	}
+
+	// restore the contract
+	if err := c.Restore(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if err := c.Restore(contract.ID); err == nil {
+		t.Fatal("expected second restore to fail")
+	} else if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != contract.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+
+	// expired contracts should be archived automatically
+	srv.archiveExpired(contract.EndHeight + archiveDelay)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 {
+		t.Fatal("contract should not have been archived yet")
+	}
+	srv.archiveExpired(contract.EndHeight + archiveDelay + 1)
+	if contracts, err := c.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("contract should have been archived:", contracts)
+	} else if entries, err := c.Audit(AuditQuery{Action: "archive"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Caller != "autoarchive" {
+		t.Fatal("wrong audit entries:", entries)
+	}
+
+	// the archive should persist across restarts
+	srv.store.Close()
+	srv, err = newServer(srv.dir, stubWallet{}, stubTpool{}, "http://localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.store.Close()
+	if len(srv.archive) != 1 || srv.archive[0].ID != contract.ID {
+		t.Fatal("archive was not persisted:", srv.archive)
+	}
+}
+
+func TestContractQuery(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var formed []Contract
+	for _, end := range []types.BlockHeight{20, 10, 30} {
+		contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+end, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		formed = append(formed, contract)
+	}
+
+	// filters
+	if cs, _, err := c.QueryContracts(ContractQuery{Status: "active", MaxEndHeight: currentHeight + 20}); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 2 {
+		t.Fatal("wrong contracts:", cs)
+	} else if cs, _, err := c.QueryContracts(ContractQuery{Status: "expired"}); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 0 {
+		t.Fatal("wrong contracts:", cs)
+	} else if cs, _, err := c.QueryContracts(ContractQuery{IDPrefix: formed[2].ID.String()[:8]}); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 1 || cs[0].ID != formed[2].ID || cs[0].HostAddress == "" {
+		t.Fatal("wrong contracts:", cs)
+	} else if cs, _, err := c.QueryContracts(ContractQuery{HostKey: "ed25519:foo"}); err != nil {
+		t.Fatal(err)
+	} else if len(cs) != 0 {
+		t.Fatal("wrong contracts:", cs)
+	} else if _, _, err := c.QueryContracts(ContractQuery{Sort: "foo"}); err == nil {
+		t.Fatal("expected invalid sort to be rejected")
+	}
+
+	// sort by descending end height, one page at a time
+	var ends []types.BlockHeight
+	q := ContractQuery{Sort: "-endHeight", Limit: 2}
+	for {
+		cs, next, err := c.QueryContracts(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cs {
+			ends = append(ends, c.EndHeight-currentHeight)
+		}
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	if len(ends) != 3 || ends[0] != 30 || ends[1] != 20 || ends[2] != 10 {
+		t.Fatal("wrong order:", ends)
+	}
+}
+
+func TestResolveAddresses(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings); err != nil {
+		t.Fatal(err)
+	}
+	// add a contract with a host that shard doesn't know about
+	srv.mu.Lock()
+	srv.contracts = append(srv.contracts, Contract{
+		Contract: renter.Contract{
+			HostKey:   "ed25519:0000000000000000000000000000000000000000000000000000000000000000",
+			RenterKey: ed25519.NewKeyFromSeed(make([]byte, 32)),
+		},
+		HostAddress: "old.example.com:9982",
+	})
+	srv.mu.Unlock()
+
+	// the unknown host should not cause the whole request to fail
+	for i := 0; i < 2; i++ {
+		contracts, err := c.AllContracts()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(contracts) != 2 {
+			t.Fatal("wrong contracts:", contracts)
+		} else if contracts[0].HostAddress != settings.NetAddress || contracts[0].AddressError != "" {
+			t.Fatal("wrong address:", contracts[0].HostAddress, contracts[0].AddressError)
+		} else if contracts[1].HostAddress != "old.example.com:9982" || contracts[1].AddressError == "" {
+			t.Fatal("expected last known address and error:", contracts[1].HostAddress, contracts[1].AddressError)
+		}
+	}
+	// the second request should have hit the cache for the known host
+	srv.metrics.mu.Lock()
+	hits := srv.metrics.resolveCacheHits
+	srv.metrics.mu.Unlock()
+	if hits != 1 {
+		t.Fatal("expected 1 cache hit, got", hits)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	defer func(d time.Duration) { webhookBackoff = d }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fail the first delivery, to exercise retries
+	events := make(chan Event, 10)
+	var secret string
+	var failed bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("X-Muse-Signature") != WebhookSignature(secret, body) {
+			t.Error("bad signature")
+		} else if bytes.Contains(body, []byte("renterKey")) {
+			t.Error("payload contains renter key")
+		}
+		if !failed {
+			failed = true
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+		}
+		events <- ev
+	}))
+	defer receiver.Close()
+	nextEvent := func() Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+
+	if _, err := c.AddWebhook(Webhook{URL: receiver.URL, Events: []string{"foo"}}); err == nil {
+		t.Fatal("expected unknown event type to be rejected")
+	}
+	hook, err := c.AddWebhook(Webhook{URL: receiver.URL, Events: []string{EventForm, EventExpiring}})
+	if err != nil {
+		t.Fatal(err)
+	} else if hook.ID == "" || hook.Secret == "" {
+		t.Fatal("webhook was not assigned an ID and secret:", hook)
+	}
+	secret = hook.Secret
+	if hooks, err := c.Webhooks(); err != nil {
+		t.Fatal(err)
+	} else if len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != "" {
+		t.Fatal("wrong webhooks:", hooks)
+	}
+
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(); ev.Type != EventForm || ev.Contract == nil || ev.Contract.ID != contract.ID {
+		t.Fatal("wrong event:", ev)
+	}
+	var deliveries []WebhookDelivery
+	for i := 0; i < 100 && len(deliveries) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if deliveries, err = c.WebhookDeliveries(hook.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deliveries) != 2 || deliveries[0].StatusCode != http.StatusServiceUnavailable || deliveries[1].Attempt != 2 || deliveries[1].Error != "" {
+		t.Fatal("wrong deliveries:", deliveries)
+	}
+
+	// expiring contracts should only be reported once
+	srv.notifyExpiring(contract.EndHeight - 1)
+	if ev := nextEvent(); ev.Type != EventExpiring || ev.Contract.ID != contract.ID {
+		t.Fatal("wrong event:", ev)
+	}
+	srv.notifyExpiring(contract.EndHeight - 1)
+	if _, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+20, settings); err != nil {
+		t.Fatal(err)
+	} else if ev := nextEvent(); ev.Type != EventForm {
+		t.Fatal("wrong event:", ev)
+	}
+
+	if err := c.DeleteWebhook(hook.ID); err != nil {
+		t.Fatal(err)
+	} else if hooks, err := c.Webhooks(); err != nil {
+		t.Fatal(err)
+	} else if len(hooks) != 0 {
+		t.Fatal("webhook was not deleted:", hooks)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewals, err := c.Watch(ctx, EventRenew)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Watch(ctx, "foo"); err == nil {
+		t.Fatal("expected unknown event type to be rejected")
+	}
+	nextEvent := func(ch <-chan Event) Event {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	} else if ev := nextEvent(events); ev.Type != EventForm || ev.Contract.ID != contract.ID || ev.Contract.RenterKey != nil {
+		t.Fatal("wrong event:", ev)
+	}
+	renewed, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []<-chan Event{events, renewals} {
+		if ev := nextEvent(ch); ev.Type != EventRenew || ev.Contract.ID != renewed.ID || ev.Contract.RenewedFrom != contract.ID {
+			t.Fatal("wrong event:", ev)
+		}
+	}
+	if err := c.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if ev := nextEvent(events); ev.Type != EventDelete || ev.Contract.ID != contract.ID {
+		t.Fatal("wrong event:", ev)
+	}
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if ev := nextEvent(events); ev.Type != EventHostSet || ev.HostSet != "foo" {
+		t.Fatal("wrong event:", ev)
+	}
+
+	// cancelling the context should close the channel
+	cancel()
+	for range events {
+	}
+}
+
+func TestHostSetForm(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// include a host that shard doesn't know about
+	unknown := hostdb.HostPublicKey("ed25519:0000000000000000000000000000000000000000000000000000000000000000")
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey(), unknown}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FormHostSet("bar", types.ZeroCurrency, currentHeight, currentHeight+10); err == nil {
+		t.Fatal("expected unknown host set to be rejected")
+	}
+
+	// the unknown host should fail without affecting the other
+	results, err := c.FormHostSet("foo", types.ZeroCurrency, currentHeight, currentHeight+10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatal("wrong results:", results)
+	}
+	for _, r := range results {
+		if r.HostKey == host.PublicKey() && (r.Contract == nil || r.Error != "") {
+			t.Fatal("expected formation to succeed:", r)
+		} else if r.HostKey == unknown && (r.Contract != nil || r.Error == "") {
+			t.Fatal("expected formation to fail:", r)
+		}
+	}
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].HostKey != host.PublicKey() {
+		t.Fatal("wrong contracts:", contracts)
+	}
+
+	// hosts with active contracts should be skipped
+	if results, err := c.FormHostSet("foo", types.ZeroCurrency, currentHeight, currentHeight+10); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 1 || results[0].HostKey != unknown {
+		t.Fatal("wrong results:", results)
+	}
+}
+
+func TestHostSetFormBudget(t *testing.T) {
+	_, c, hosts, stop := newTestServerHosts(t, 6)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set []hostdb.HostPublicKey
+	for _, h := range hosts {
+		set = append(set, h.PublicKey())
+	}
+	if err := c.SetHostSet("foo", set); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FormHostSet("foo", types.ZeroCurrency, currentHeight+10, currentHeight+10); err == nil {
+		t.Fatal("expected invalid heights to be rejected")
+	}
+
+	// the budget only fits two contracts; the concurrent formations must not
+	// collectively exceed it
+	funds := types.NewCurrency64(100)
+	if err := c.SetBudget("foo", Budget{Allowance: types.NewCurrency64(250), Period: 100}); err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.FormHostSet("foo", funds, currentHeight, currentHeight+10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != len(hosts) {
+		t.Fatal("wrong results:", results)
+	}
+	var formed int
+	for _, r := range results {
+		if r.Contract != nil {
+			formed++
+		} else if !strings.Contains(r.Error, "exceed budget") {
+			t.Fatal("unexpected error:", r.Error)
+		}
+	}
+	if formed != 2 {
+		t.Fatal("expected exactly two contracts to be formed, got", formed)
+	}
+	if entries, err := c.Ledger(LedgerQuery{HostSet: "foo"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatal("wrong ledger:", entries)
+	}
+}
+
+func TestHostSetRenew(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := hostdb.HostPublicKey("ed25519:0000000000000000000000000000000000000000000000000000000000000000")
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey(), unknown}); err != nil {
+		t.Fatal(err)
+	}
+	funds := types.NewCurrency64(100)
+	if _, err := c.FormHostSet("foo", funds, currentHeight, currentHeight+10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RenewHostSet("foo", "bogus", funds, currentHeight, currentHeight+20); err == nil {
+		t.Fatal("expected unknown funds policy to be rejected")
+	}
+
+	// the host without a contract should fail without affecting the other
+	results, err := c.RenewHostSet("foo", FundsSame, types.ZeroCurrency, currentHeight, currentHeight+20)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatal("wrong results:", results)
+	}
+	var renewed Contract
+	for _, r := range results {
+		if r.HostKey == host.PublicKey() && (r.Contract == nil || r.Error != "") {
+			t.Fatal("expected renewal to succeed:", r)
+		} else if r.HostKey == unknown && (r.Contract != nil || r.Error == "") {
+			t.Fatal("expected renewal to fail:", r)
+		} else if r.Contract != nil {
+			renewed = *r.Contract
+		}
+	}
+	if renewed.EndHeight != currentHeight+20 {
+		t.Fatal("wrong end height:", renewed.EndHeight)
+	}
+	// the renewal should have used the same funds as the original formation
+	if entries, err := c.Ledger(LedgerQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || !entries[1].Funds.Equals(funds) {
+		t.Fatal("wrong ledger:", entries)
+	}
+
+	// the renewed contract should now be the latest
+	if contracts, err := c.Contracts("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != renewed.ID {
+		t.Fatal("wrong contracts:", contracts)
+	}
+}
+
+func TestFundsEstimate(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	w := new(spendWallet)
+	srv.wallet = w
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := FundsTarget{Storage: 1 << 20, Upload: 1 << 20, Download: 1 << 22}
+
+	// check the math against a host with nonzero prices
+	e := EstimateFunds(hostdb.HostSettings{
+		ContractPrice:          types.NewCurrency64(1000),
+		StoragePrice:           types.NewCurrency64(1),
+		UploadBandwidthPrice:   types.NewCurrency64(2),
+		DownloadBandwidthPrice: types.NewCurrency64(3),
+		Collateral:             types.NewCurrency64(1),
+		MaxCollateral:          types.NewCurrency64(1 << 20),
+	}, target, currentHeight, 10)
+	if !e.Funds.Equals64(10<<20 + 2<<20 + 3<<22) {
+		t.Fatal("wrong funds:", e.Funds)
+	} else if !e.HostFee.Equals64(1000) {
+		t.Fatal("wrong host fee:", e.HostFee)
+	} else if !e.HostCollateral.Equals64(1 << 20) {
+		t.Fatal("collateral should be capped:", e.HostCollateral)
+	} else if payout := e.Funds.Add(e.HostFee).Add(e.HostCollateral).Add(e.SiafundFee); !e.SiafundFee.Equals(types.Tax(currentHeight, payout)) {
+		t.Fatal("wrong siafund fee:", e.SiafundFee)
+	} else if !e.TotalCost.Equals(e.Funds.Add(e.HostFee).Add(e.SiafundFee)) {
+		t.Fatal("wrong total cost:", e.TotalCost)
+	}
+
+	// funds and target are mutually exclusive
+	err = c.post("/form", RequestForm{
+		HostKey:     host.PublicKey(),
+		Funds:       types.NewCurrency64(1),
+		Target:      &target,
+		StartHeight: currentHeight,
+		EndHeight:   currentHeight + 10,
+		Settings:    settings,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected request with both funds and target to be rejected")
+	}
+
+	// the estimate should be computed from the server's own scan, not the
+	// supplied settings, and its total cost should match the wallet's spend
+	host.prices = hostdb.HostSettings{
+		ContractPrice:          types.NewCurrency64(1000),
+		StoragePrice:           types.NewCurrency64(1),
+		UploadBandwidthPrice:   types.NewCurrency64(2),
+		DownloadBandwidthPrice: types.NewCurrency64(3),
+		Collateral:             types.NewCurrency64(1),
+		MaxCollateral:          types.SiacoinPrecision,
+	}
+	scanned := host.settings()
+	spent := func() types.Currency {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		s := w.spent
+		w.spent = types.ZeroCurrency
+		return s
+	}
+	exp := EstimateFunds(scanned, target, currentHeight, 10)
+	contract, e, err := c.FormTarget(host.PublicKey(), target, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(e, exp) {
+		t.Fatal("wrong estimate:", e)
+	} else if s := spent(); !e.TotalCost.Equals(s) {
+		t.Fatalf("estimated total cost %v does not match wallet spend %v", e.TotalCost, s)
+	}
+	_, e, err = c.RenewTarget(contract.ID, target, currentHeight, currentHeight+20, settings)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := estimateFunds(scanned, target, &contract, currentHeight, currentHeight+20); !reflect.DeepEqual(e, exp) {
+		t.Fatal("wrong estimate:", e)
+	} else if s := spent(); !e.TotalCost.Equals(s) {
+		t.Fatalf("estimated total cost %v does not match wallet spend %v", e.TotalCost, s)
+	}
+	if entries, err := c.Ledger(LedgerQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || !entries[0].Funds.Equals(exp.Funds) || !entries[1].Funds.Equals(e.Funds) {
+		t.Fatal("wrong ledger:", entries)
+	} else if !entries[0].Total().Equals(exp.TotalCost) || !entries[1].Total().Equals(e.TotalCost) {
+		t.Fatal("ledger does not match estimates:", entries)
+	}
+}
+
+func TestPriceLimits(t *testing.T) {
+	limits := PriceLimits{
+		MaxStoragePrice:    types.NewCurrency64(10),
+		MinCollateralRatio: 2,
+		MaxWindowSize:      100,
+	}
+	settings := hostdb.HostSettings{
+		StoragePrice: types.NewCurrency64(10),
+		Collateral:   types.NewCurrency64(20),
+		WindowSize:   100,
+	}
+	if err := limits.check(settings); err != nil {
+		t.Fatal(err)
+	}
+	settings.StoragePrice = types.NewCurrency64(11)
+	if err := limits.check(settings); err == nil || !strings.Contains(err.Error(), "maxStoragePrice") {
+		t.Fatal("expected maxStoragePrice violation, got", err)
+	}
+	settings.StoragePrice = types.NewCurrency64(10)
+	settings.Collateral = types.NewCurrency64(19)
+	if err := limits.check(settings); err == nil || !strings.Contains(err.Error(), "minCollateralRatio") {
+		t.Fatal("expected minCollateralRatio violation, got", err)
+	}
+
+	// the test host has a window size of 144
+	_, c, host, stop := newTestServer(t, WithPriceLimits(PriceLimits{MaxWindowSize: 100}))
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, hs)
+	if err == nil || !strings.Contains(err.Error(), "maxWindowSize") {
+		t.Fatal("expected maxWindowSize violation, got", err)
+	}
+	// limits are checked against the host's actual settings, not the settings
+	// supplied by the client
+	fake := hs
+	fake.WindowSize = 50
+	_, err = c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, fake)
+	if err == nil || !strings.Contains(err.Error(), "maxWindowSize") {
+		t.Fatal("expected maxWindowSize violation, got", err)
+	}
+
+	// a host set can override the server-wide limit
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetPriceLimits("foo", PriceLimits{MaxWindowSize: 200}); err != nil {
+		t.Fatal(err)
+	} else if l, err := c.PriceLimits("foo"); err != nil {
+		t.Fatal(err)
+	} else if l.MaxWindowSize != 200 {
+		t.Fatal("wrong price limits:", l)
+	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the contract should be formed with the host's actual settings, too
+	fake.ContractPrice = types.NewCurrency64(1000)
+	if _, err := c.Form(host.PublicKey(), types.NewCurrency64(1), currentHeight, currentHeight+10, fake); err != nil {
+		t.Fatal(err)
+	} else if entries, err := c.Ledger(LedgerQuery{}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || !entries[1].HostFee.IsZero() {
+		t.Fatal("contract should have been formed with scanned settings:", entries)
+	}
+
+	// a tighter override should be enforced on renewal, too
+	if err := c.SetPriceLimits("foo", PriceLimits{MaxContractPrice: types.NewCurrency64(1), MaxWindowSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, hs)
+	if err == nil || !strings.Contains(err.Error(), "maxWindowSize") {
+		t.Fatal("expected maxWindowSize violation, got", err)
+	}
+	fake.WindowSize = 5
+	_, err = c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, fake)
+	if err == nil || !strings.Contains(err.Error(), "maxWindowSize") {
+		t.Fatal("expected maxWindowSize violation, got", err)
+	}
+}
 
-func startSHARD(hpk hostdb.HostPublicKey, ann []byte) (string, func() error) {
-	l, err := net.Listen("tcp", ":0")
+func TestHostRules(t *testing.T) {
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
 	if err != nil {
-		return "", nil
+		t.Fatal(err)
 	}
-	p := &memPersist{
-		PersistData: shard.PersistData{
-			Hosts: map[hostdb.HostPublicKey][]byte{hpk: ann},
-		},
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
 	}
-	r, err := shard.NewRelay(mockCS{}, p)
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
 	if err != nil {
-		return "", nil
+		t.Fatal(err)
+	}
+
+	if _, err := c.AddHostRule(HostRule{Action: "ban", HostKey: host.PublicKey()}); err == nil {
+		t.Fatal("expected invalid action to be rejected")
+	} else if _, err := c.AddHostRule(HostRule{Action: HostRuleBlock, Network: "not a network"}); err == nil {
+		t.Fatal("expected invalid network to be rejected")
+	}
+	rule, err := c.BlockHost(host.PublicKey(), "lost data")
+	if err != nil {
+		t.Fatal(err)
+	} else if rules, err := c.HostRules(); err != nil {
+		t.Fatal(err)
+	} else if len(rules) != 1 || rules[0].ID != rule.ID || rules[0].Reason != "lost data" {
+		t.Fatal("wrong rules:", rules)
+	}
+
+	// a blocked host cannot be used for anything
+	if _, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings); err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Fatal("expected formation to be blocked, got", err)
+	} else if _, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, settings); err == nil {
+		t.Fatal("expected renewal to be blocked")
+	} else if err := c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err == nil {
+		t.Fatal("expected host set to be rejected")
+	}
+	if err := c.DeleteHostRule(rule.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// once an allow rule exists, other hosts are forbidden
+	allowNet, err := c.AddHostRule(HostRule{Action: HostRuleAllow, Network: "192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings); err == nil || !strings.Contains(err.Error(), "allowlist") {
+		t.Fatal("expected formation to be forbidden, got", err)
+	}
+	if _, err := c.AddHostRule(HostRule{Action: HostRuleAllow, HostKey: host.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteHostRule(allowNet.ID); err != nil {
+		t.Fatal(err)
+	} else if err := c.DeleteHostRule(allowNet.ID); err == nil {
+		t.Fatal("expected deleting a nonexistent rule to fail")
 	}
-	srv := shard.NewServer(r)
-	go http.Serve(l, srv)
-	return "http://" + l.Addr().String(), l.Close
 }
 
-func TestServer(t *testing.T) {
-	// create a host
-	host, err := newHost(":0")
+func TestRecommendHosts(t *testing.T) {
+	// a cheaper host should outrank an otherwise identical one
+	infos := []HostInfo{
+		{PublicKey: "ed25519:01", TotalScans: 1, SuccessfulScans: 1, Settings: hostdb.HostSettings{StoragePrice: types.NewCurrency64(2), Collateral: types.NewCurrency64(4), RemainingStorage: 1 << 30}},
+		{PublicKey: "ed25519:02", TotalScans: 1, SuccessfulScans: 1, Settings: hostdb.HostSettings{StoragePrice: types.NewCurrency64(1), Collateral: types.NewCurrency64(2), RemainingStorage: 1 << 30}},
+	}
+	scores := scoreHosts(infos, FundsTarget{Storage: 1 << 20}, 0, 10)
+	if len(scores) != 2 || scores[0].HostKey != "ed25519:02" || scores[0].Score != 1 || scores[1].PriceScore >= 1 {
+		t.Fatal("wrong scores:", scores)
+	}
+
+	_, c, host, stop := newTestServer(t)
+	defer stop()
+	if _, err := c.RecommendHosts(RequestRecommend{}); err == nil {
+		t.Fatal("expected zero count to be rejected")
+	}
+	// the unknown host cannot be scanned, so it should be discarded
+	unknown := hostdb.HostPublicKey("ed25519:0000000000000000000000000000000000000000000000000000000000000000")
+	req := RequestRecommend{
+		Count:      2,
+		Duration:   10,
+		Candidates: []hostdb.HostPublicKey{host.PublicKey(), unknown},
+	}
+	scores, err := c.RecommendHosts(req)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(scores) != 1 || scores[0].HostKey != host.PublicKey() || scores[0].Score != 1 {
+		t.Fatal("wrong scores:", scores)
 	}
-	defer host.Close()
-	// create a shard server
-	shardAddr, stop := startSHARD(host.PublicKey(), host.announcement())
+
+	// hosts that we've scanned before are candidates, unless they're excluded
+	// or forbidden
+	req.Candidates = nil
+	if scores, err := c.RecommendHosts(req); err != nil {
+		t.Fatal(err)
+	} else if len(scores) != 1 {
+		t.Fatal("wrong scores:", scores)
+	}
+	req.Exclude = []hostdb.HostPublicKey{host.PublicKey()}
+	if scores, err := c.RecommendHosts(req); err != nil {
+		t.Fatal(err)
+	} else if len(scores) != 0 {
+		t.Fatal("excluded host should not be recommended:", scores)
+	}
+	req.Exclude = nil
+	if _, err := c.BlockHost(host.PublicKey(), ""); err != nil {
+		t.Fatal(err)
+	} else if scores, err := c.RecommendHosts(req); err != nil {
+		t.Fatal(err)
+	} else if len(scores) != 0 {
+		t.Fatal("blocked host should not be recommended:", scores)
+	}
+	req.Candidates = make([]hostdb.HostPublicKey, maxRecommendCandidates+1)
+	if _, err := c.RecommendHosts(req); err == nil {
+		t.Fatal("expected too many candidates to be rejected")
+	}
+
+	// a fresh server should recommend the hosts announced on the blockchain,
+	// once it has discovered them
+	srv, c, hosts, stop := newTestServerHosts(t, 20)
 	defer stop()
+	req = RequestRecommend{Count: 20, Duration: 10}
+	if scores, err := c.RecommendHosts(req); err != nil {
+		t.Fatal(err)
+	} else if len(scores) != 0 {
+		t.Fatal("undiscovered hosts should not be recommended:", scores)
+	}
+	srv.discoverHosts()
+	if scores, err := c.RecommendHosts(req); err != nil {
+		t.Fatal(err)
+	} else if len(scores) != len(hosts) {
+		t.Fatal("wrong number of recommended hosts:", len(scores))
+	}
+}
 
-	// create the muse server
-	dir, _ := ioutil.TempDir("", t.Name())
-	defer os.RemoveAll(dir)
-	srv, err := NewServer(dir, stubWallet{}, stubTpool{}, shardAddr)
+func TestHealPolicy(t *testing.T) {
+	srv, c, hosts, stop := newTestServerHosts(t, 2)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
 	if err != nil {
 		t.Fatal(err)
 	}
-	l, err := net.Listen("tcp", ":0")
+
+	bad, good := hosts[0], hosts[1]
+	if err := c.SetHostSet("foo", []hostdb.HostPublicKey{bad.PublicKey()}); err != nil {
+		t.Fatal(err)
+	} else if err := c.SetHealPolicy("foo", HealPolicy{MaxFailedScans: 2}); err == nil {
+		t.Fatal("expected policy without duration to be rejected")
+	} else if err := c.SetHealPolicy("foo", HealPolicy{MaxFailedScans: 2, Duration: 10}); err != nil {
+		t.Fatal(err)
+	} else if policy, err := c.HealPolicy("foo"); err != nil {
+		t.Fatal(err)
+	} else if policy.MaxFailedScans != 2 {
+		t.Fatal("wrong policy:", policy)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Watch(ctx, EventHostReplaced)
 	if err != nil {
 		t.Fatal(err)
 	}
-	go http.Serve(l, srv)
 
-	// test contract formation
-	c := NewClient("http://" + l.Addr().String())
-	if contracts, err := c.AllContracts(); err != nil {
+	// scan both hosts, then take one offline
+	for _, h := range hosts {
+		if _, err := c.Scan(h.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad.Close()
+	srv.scanHost(bad.PublicKey())
+
+	// one failure is not enough to trigger a replacement
+	srv.healHostSets(currentHeight)
+	if set, err := c.HostSet("foo"); err != nil {
 		t.Fatal(err)
-	} else if len(contracts) != 0 {
+	} else if len(set) != 1 || set[0] != bad.PublicKey() {
+		t.Fatal("host should not have been replaced yet:", set)
+	}
+	srv.scanHost(bad.PublicKey())
+	srv.healHostSets(currentHeight)
+	if set, err := c.HostSet("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(set) != 1 || set[0] != good.PublicKey() {
+		t.Fatal("host should have been replaced:", set)
+	}
+	contracts, err := c.Contracts("foo")
+	if err != nil {
 		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].HostKey != good.PublicKey() || contracts[0].EndHeight != currentHeight+10 {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	select {
+	case ev := <-events:
+		if ev.HostKey != bad.PublicKey() || ev.HostSet != "foo" || ev.Contract == nil || ev.Contract.ID != contracts[0].ID || ev.Error == "" {
+			t.Fatal("wrong event:", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
 	}
+}
 
-	currentHeight, err := c.SHARD().ChainHeight()
+func TestAuth(t *testing.T) {
+	srv, c, host, stop := newTestServer(t, WithAdminKey("foo"))
+	defer stop()
+	admin := c.WithAPIKey("foo")
+
+	// requests without a valid key should be rejected
+	if _, err := c.AllContracts(); err == nil {
+		t.Fatal("expected unauthenticated request to fail")
+	} else if _, err := c.WithAPIKey("bar").AllContracts(); err == nil {
+		t.Fatal("expected request with invalid key to fail")
+	}
+	// shard proxy requires auth too
+	if _, err := c.SHARD().ChainHeight(); err == nil {
+		t.Fatal("expected unauthenticated shard request to fail")
+	}
+	currentHeight, err := admin.SHARD().ChainHeight()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	settings, err := c.Scan(host.PublicKey())
+	aliceKey, err := admin.CreateTenant("alice")
 	if err != nil {
 		t.Fatal(err)
 	}
+	bobKey, err := admin.CreateTenant("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := c.WithAPIKey(aliceKey), c.WithAPIKey(bobKey)
+	if _, err := alice.SHARD().ChainHeight(); err != nil {
+		t.Fatal(err)
+	}
+	if tenants, err := admin.Tenants(); err != nil {
+		t.Fatal(err)
+	} else if len(tenants) != 2 || tenants[0] != "alice" || tenants[1] != "bob" {
+		t.Fatal("wrong tenants:", tenants)
+	} else if _, err := alice.Tenants(); err == nil {
+		t.Fatal("tenants should not be able to list tenants")
+	}
 
-	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+1, settings)
+	// form a contract as alice; bob should not be able to see or touch it
+	settings, err := alice.Scan(host.PublicKey())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if contracts, err := c.AllContracts(); err != nil {
+	contract, err := alice.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contracts, err := alice.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 || contracts[0].ID != contract.ID || contracts[0].Tenant != "alice" {
+		t.Fatal("wrong contracts:", contracts)
+	}
+	if contracts, err := bob.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("bob should not see alice's contracts:", contracts)
+	}
+	if contracts, err := admin.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 {
+		t.Fatal("admin should see all contracts:", contracts)
+	}
+	if _, err := bob.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+20, settings); err == nil {
+		t.Fatal("bob should not be able to renew alice's contract")
+	}
+	// likewise, bob should not see the statistics of alice's host
+	if infos, err := alice.Hosts(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 || infos[0].PublicKey != host.PublicKey() {
+		t.Fatal("wrong hosts:", infos)
+	} else if infos, err := bob.Hosts(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 0 {
+		t.Fatal("bob should not see alice's hosts:", infos)
+	} else if _, err := bob.HostInfo(host.PublicKey()); err == nil {
+		t.Fatal("bob should not see alice's host")
+	} else if infos, err := admin.Hosts(); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 {
+		t.Fatal("admin should see all hosts:", infos)
+	}
+	if err := bob.Delete(contract.ID); err != nil {
+		t.Fatal(err)
+	} else if contracts, err := alice.AllContracts(); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 1 {
+		t.Fatal("bob should not be able to delete alice's contract")
+	}
+
+	// host sets are owned by their creator
+	hosts := []hostdb.HostPublicKey{host.PublicKey()}
+	if err := alice.SetHostSet("foo", hosts); err != nil {
+		t.Fatal(err)
+	} else if err := bob.SetHostSet("foo", nil); err == nil {
+		t.Fatal("bob should not be able to modify alice's host set")
+	} else if _, err := bob.HostSet("foo"); err == nil {
+		t.Fatal("bob should not be able to view alice's host set")
+	} else if sets, err := bob.HostSets(); err != nil {
+		t.Fatal(err)
+	} else if len(sets) != 0 {
+		t.Fatal("bob should not see alice's host sets:", sets)
+	}
+	if contracts, err := alice.Contracts("foo"); err != nil {
 		t.Fatal(err)
 	} else if len(contracts) != 1 || contracts[0].ID != contract.ID {
 		t.Fatal("wrong contracts:", contracts)
 	}
-	// test contract renewal
-	newContract, err := c.Renew(contract.ID, types.ZeroCurrency, currentHeight, currentHeight+2, settings)
+	// bob's host set containing the same host should not include alice's contract
+	if err := bob.SetHostSet("bar", hosts); err != nil {
+		t.Fatal(err)
+	} else if contracts, err := bob.Contracts("bar"); err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 0 {
+		t.Fatal("bob should not see alice's contracts:", contracts)
+	} else if _, err := bob.HostInfo(host.PublicKey()); err != nil {
+		t.Fatal("bob should see the hosts in his host set:", err)
+	}
+
+	// tenants may not register webhooks on the server's own network
+	for _, u := range []string{"http://127.0.0.1:9580/", "http://localhost/", "http://10.1.2.3/", "http://[::1]/", "http://169.254.169.254/latest/meta-data"} {
+		if _, err := alice.AddWebhook(Webhook{URL: u}); err == nil {
+			t.Fatal("expected private webhook URL to be rejected:", u)
+		}
+	}
+	if _, err := admin.AddWebhook(Webhook{URL: "http://127.0.0.1:9580/", Events: []string{EventRestore}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenantWebhookClient.Transport.(*http.Transport).DialContext(context.Background(), "tcp", "127.0.0.1:9580"); err == nil {
+		t.Fatal("expected tenant webhook client to refuse private address")
+	}
+
+	// when a host goes offline, each tenant using it should be notified
+	carolKey, err := admin.CreateTenant("carol")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if contracts, err := c.AllContracts(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := func(c *Client) <-chan Event {
+		events, err := c.Watch(ctx, EventHostOffline, EventHostSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	nextEvent := func(ch <-chan Event) Event {
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+	carol := c.WithAPIKey(carolKey)
+	aliceEvents, bobEvents, carolEvents := watch(alice), watch(bob), watch(carol)
+	host.Close()
+	srv.scanHost(host.PublicKey())
+	if ev := nextEvent(aliceEvents); ev.Type != EventHostOffline || ev.Tenant != "alice" || ev.HostKey != host.PublicKey() {
+		t.Fatal("wrong event:", ev)
+	} else if ev := nextEvent(bobEvents); ev.Type != EventHostOffline || ev.Tenant != "bob" {
+		t.Fatal("wrong event:", ev)
+	}
+	if err := carol.SetHostSet("baz", nil); err != nil {
 		t.Fatal(err)
-	} else if len(contracts) != 2 || contracts[1].ID != newContract.ID {
-		t.Fatal("wrong contracts:", contracts)
+	} else if ev := nextEvent(carolEvents); ev.Type != EventHostSet {
+		t.Fatal("carol should not be notified about an unrelated host:", ev)
 	}
 
-	// test host sets
-	if err = c.SetHostSet("foo", []hostdb.HostPublicKey{host.PublicKey()}); err != nil {
+	// revoked keys should no longer work
+	if err := admin.DeleteTenant("alice"); err != nil {
 		t.Fatal(err)
+	} else if _, err := alice.AllContracts(); err == nil {
+		t.Fatal("expected revoked key to be rejected")
 	}
-	if sets, err := c.HostSets(); err != nil {
+	// tenant changes should be audited
+	if entries, err := admin.Audit(AuditQuery{Action: "tenant"}); err != nil {
 		t.Fatal(err)
-	} else if len(sets) != 1 || sets[0] != "foo" {
-		t.Fatal("wrong host sets:", sets)
+	} else if len(entries) != 4 || entries[0].Summary != "created tenant alice" || entries[3].Summary != "deleted tenant alice" || entries[3].Caller != "admin" {
+		t.Fatal("wrong tenant audit entries:", entries)
 	}
-	if set, err := c.HostSet("foo"); err != nil {
+}
+
+func TestEncryption(t *testing.T) {
+	srv, c, host, stop := newTestServer(t)
+	defer stop()
+	currentHeight, err := c.SHARD().ChainHeight()
+	if err != nil {
 		t.Fatal(err)
-	} else if len(set) != 1 || set[0] != host.PublicKey() {
-		t.Fatal("wrong host set:", set)
 	}
-	if contracts, err := c.Contracts("foo"); err != nil {
+	settings, err := c.Scan(host.PublicKey())
+	if err != nil {
 		t.Fatal(err)
-	} else if len(contracts) != 1 || contracts[0].ID != newContract.ID {
-		t.Fatal("wrong contracts:", contracts)
 	}
+	contract, err := c.Form(host.PublicKey(), types.ZeroCurrency, currentHeight, currentHeight+10, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawContract := func(store Store) (data []byte) {
+		store.View(func(tx Tx) error {
+			data = tx.Get(bucketContracts, contract.ID[:])
+			return nil
+		})
+		return
+	}
+	renterKey, _ := json.Marshal(contract.RenterKey)
+	if !bytes.Contains(rawContract(srv.store), renterKey) {
+		t.Fatal("expected plaintext contract")
+	}
+	srv.store.Close()
 
-	// test deletion
-	if err := c.Delete(contract.ID); err != nil {
+	// restarting with a key should encrypt the existing contract
+	key := frand.Entropy256()
+	srv2, err := newServer(srv.dir, stubWallet{}, stubTpool{}, "http://localhost:0", WithEncryptionKey(key))
+	if err != nil {
 		t.Fatal(err)
-	} else if contracts, err := c.AllContracts(); err != nil {
+	} else if len(srv2.contracts) != 1 || srv2.contracts[0].ID != contract.ID {
+		t.Fatal("wrong contracts:", srv2.contracts)
+	}
+	if data := rawContract(srv2.store); bytes.Contains(data, renterKey) || !bytes.HasPrefix(data, encryptedPrefix) {
+		t.Fatal("expected encrypted contract")
+	}
+	srv2.store.Close()
+
+	// restarting with the same key should succeed; restarting with the wrong
+	// key, or without a key, should fail
+	srv3, err := newServer(srv.dir, stubWallet{}, stubTpool{}, "http://localhost:0", WithEncryptionKey(key))
+	if err != nil {
 		t.Fatal(err)
-	} else if len(contracts) != 1 || contracts[0].ID != newContract.ID {
-		t.Fatal("wrong contracts:", contracts)
+	} else if len(srv3.contracts) != 1 || !bytes.Equal(srv3.contracts[0].RenterKey, contract.RenterKey) {
+		t.Fatal("wrong contracts:", srv3.contracts)
 	}
+	srv3.store.Close()
+	if _, err := newServer(srv.dir, stubWallet{}, stubTpool{}, "http://localhost:0", WithEncryptionKey(frand.Entropy256())); err == nil {
+		t.Fatal("expected wrong key to fail")
+	}
+	if _, err := newServer(srv.dir, stubWallet{}, stubTpool{}, "http://localhost:0"); err == nil {
+		t.Fatal("expected missing key to fail")
+	}
+}
 
-	// test context cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	if _, err := c.WithContext(ctx).AllContracts(); err != nil {
-		t.Fatal("should not fail with uncancelled context:", err)
+func TestClientErrors(t *testing.T) {
+	_, c, _, stop := newTestServer(t, WithAdminKey("foo"))
+	defer stop()
+
+	if _, err := c.AllContracts(); !errors.As(err, new(*UnauthorizedError)) {
+		t.Fatal("expected UnauthorizedError, got", err)
 	}
-	cancel()
-	if _, err := c.WithContext(ctx).AllContracts(); err == nil {
-		t.Fatal("should fail with cancelled context")
+	c = c.WithAPIKey("foo")
+	var nf *NotFoundError
+	if _, err := c.Contracts("nonexistent"); !errors.As(err, &nf) {
+		t.Fatal("expected NotFoundError, got", err)
+	} else if nf.StatusCode != http.StatusBadRequest || nf.Error() != "No record of that host set" {
+		t.Fatal("wrong error:", nf.StatusCode, nf)
+	}
+	if _, err := c.Ledger(LedgerQuery{HostSet: "nonexistent"}); !errors.As(err, new(*APIError)) {
+		t.Fatal("expected APIError, got", err)
+	}
+	if _, err := c.Audit(AuditQuery{Limit: -1}); !errors.As(err, new(*BadRequestError)) {
+		t.Fatal("expected BadRequestError, got", err)
+	}
+
+	// errors without a JSON body are classified by their status code
+	var attempts int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		writeErrorKind(w, "host rejected contract", http.StatusInternalServerError, ErrorKindHostRejected)
+	}))
+	defer failing.Close()
+	fc := NewClient(failing.URL).WithRetries(3, time.Millisecond)
+	if _, err := fc.Form(hostdb.HostPublicKey("ed25519:01"), types.ZeroCurrency, 0, 1, hostdb.HostSettings{}); !errors.As(err, new(*APIError)) || err.Error() != "try again" {
+		t.Fatal("expected APIError, got", err)
+	} else if attempts != 1 {
+		t.Fatal("POST should not have been retried:", attempts)
+	}
+
+	// GETs are retried after transient failures
+	attempts = 0
+	if _, err := fc.AllContracts(); !errors.As(err, new(*HostRejectedError)) {
+		t.Fatal("expected HostRejectedError, got", err)
+	} else if attempts != 3 {
+		t.Fatal("GET should have been retried:", attempts)
+	}
+	attempts = 0
+	if _, err := fc.WithRetries(0, 0).AllContracts(); err == nil || attempts != 1 {
+		t.Fatal("GET should not have been retried:", attempts, err)
+	}
+
+	// requests that never reach the server are always retried
+	var dials int
+	dc := NewClient("http://muse.invalid").WithRetries(2, time.Millisecond).WithHTTPClient(&http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials++
+				return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+			},
+		},
+	})
+	if _, err := dc.Refresh(types.FileContractID{}, types.ZeroCurrency, 0); err == nil || dials != 3 {
+		t.Fatal("expected request to be retried:", dials, err)
+	}
+}
+
+func TestLegacyImport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", t.Name())
+	defer os.RemoveAll(dir)
+
+	// write state in the legacy format, including a corrupt contract file
+	c := Contract{
+		Contract: renter.Contract{
+			HostKey:   hostdb.HostKeyFromPublicKey(make(ed25519.PublicKey, 32)),
+			ID:        types.FileContractID{1},
+			RenterKey: ed25519.NewKeyFromSeed(make([]byte, 32)),
+		},
+		EndHeight: 100,
+	}
+	js, _ := json.Marshal(c)
+	ioutil.WriteFile(filepath.Join(dir, "00000000-01000000.contract"), js, 0660)
+	ioutil.WriteFile(filepath.Join(dir, "00000000-02000000.contract"), []byte("garbage"), 0660)
+	js, _ = json.Marshal(map[string][]hostdb.HostPublicKey{"foo": {c.HostKey}})
+	ioutil.WriteFile(filepath.Join(dir, "hostSets.json"), js, 0660)
+
+	srv, err := newServer(dir, stubWallet{}, stubTpool{}, "http://localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.contracts) != 1 || srv.contracts[0].ID != c.ID || !bytes.Equal(srv.contracts[0].RenterKey, c.RenterKey) {
+		t.Fatal("wrong contracts:", srv.contracts)
+	} else if hosts := srv.hostSets["foo"]; len(hosts) != 1 || hosts[0] != c.HostKey {
+		t.Fatal("wrong host sets:", srv.hostSets)
+	}
+	if paths, err := legacyStateFiles(dir); err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 0 {
+		t.Fatal("legacy files should have been moved:", paths)
+	}
+	// imported contract files contain plaintext keys, and should not be kept;
+	// the corrupt contract file was not imported, so it should be kept
+	if paths, err := legacyStateFiles(filepath.Join(dir, "legacy")); err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 2 || filepath.Base(paths[0]) != "00000000-02000000.contract" || filepath.Base(paths[1]) != "hostSets.json" {
+		t.Fatal("wrong legacy files kept:", paths)
+	}
+	srv.store.Close()
+
+	// contract files that appear after the store is initialized are moved
+	// aside, never deleted
+	js, _ = json.Marshal(c)
+	ioutil.WriteFile(filepath.Join(dir, "00000000-03000000.contract"), js, 0660)
+
+	// state should persist across restarts
+	srv, err = newServer(dir, stubWallet{}, stubTpool{}, "http://localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.store.Close()
+	if len(srv.contracts) != 1 || len(srv.hostSets) != 1 {
+		t.Fatal("state was not persisted:", srv.contracts, srv.hostSets)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "legacy", "00000000-03000000.contract")); err != nil {
+		t.Fatal("unimported contract file should have been kept:", err)
+	} else if _, err := os.Stat(filepath.Join(dir, "legacy", "00000000-02000000.contract")); err != nil {
+		t.Fatal("corrupt contract file should have been kept:", err)
 	}
 }
 
@@ -187,8 +2235,9 @@ func TestServer(t *testing.T) {
 ///
 
 type hostContract struct {
-	rev  types.FileContractRevision
-	sigs [2]types.TransactionSignature
+	rev    types.FileContractRevision
+	sigs   [2]types.TransactionSignature
+	locked bool // locked by another renter
 }
 
 type Host struct {
@@ -196,6 +2245,7 @@ type Host struct {
 	secretKey ed25519.PrivateKey
 	listener  net.Listener
 	contracts map[types.FileContractID]*hostContract
+	prices    hostdb.HostSettings // prices reported by the Settings RPC
 }
 
 func (h *Host) PublicKey() hostdb.HostPublicKey {
@@ -203,11 +2253,11 @@ func (h *Host) PublicKey() hostdb.HostPublicKey {
 }
 
 func (h *Host) settings() hostdb.HostSettings {
-	return hostdb.HostSettings{
-		NetAddress:         h.addr,
-		AcceptingContracts: true,
-		WindowSize:         144,
-	}
+	settings := h.prices
+	settings.NetAddress = h.addr
+	settings.AcceptingContracts = true
+	settings.WindowSize = 144
+	return settings
 }
 
 func (h *Host) announcement() []byte {
@@ -271,6 +2321,8 @@ func (h *Host) handleConn(conn net.Conn) error {
 		id, err := s.sess.ReadID()
 		if errors.Cause(err) == renterhost.ErrRenterClosed {
 			return nil
+		} else if err != nil {
+			return err
 		}
 		rpcs[id](s)
 	}
@@ -335,7 +2387,7 @@ func (h *Host) rpcLock(s *hostSession) error {
 	frand.Read(newChallenge[:])
 	s.sess.SetChallenge(newChallenge)
 	resp := &renterhost.RPCLockResponse{
-		Acquired:     true,
+		Acquired:     !s.contract.locked,
 		NewChallenge: newChallenge,
 		Revision:     s.contract.rev,
 		Signatures:   s.contract.sigs[:],
@@ -343,6 +2395,17 @@ func (h *Host) rpcLock(s *hostSession) error {
 	return s.sess.WriteResponse(resp, nil)
 }
 
+// setFileSize sets the file size of the latest revision of the specified
+// contract, re-signing the revision with both keys.
+func (h *Host) setFileSize(id types.FileContractID, renterKey ed25519.PrivateKey, size uint64) {
+	c := h.contracts[id]
+	c.rev.NewFileSize = size
+	c.rev.NewRevisionNumber++
+	hash := renterhost.HashRevision(c.rev)
+	c.sigs[0].Signature = ed25519hash.Sign(renterKey, hash)
+	c.sigs[1].Signature = ed25519hash.Sign(h.secretKey, hash)
+}
+
 func (h *Host) rpcRenewContract(s *hostSession) error {
 	var req renterhost.RPCRenewAndClearContractRequest
 	s.sess.ReadRequest(&req, 4096)
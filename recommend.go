@@ -0,0 +1,248 @@
+package muse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"gitlab.com/NebulousLabs/encoding"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+const (
+	// storageHeadroom is the multiple of the target storage that a host must
+	// have remaining to receive a full storage score.
+	storageHeadroom = 10
+
+	// maxRecommendCandidates is the maximum number of candidates that may be
+	// supplied to /hosts/recommend, since stale candidates are scanned before
+	// the response is sent.
+	maxRecommendCandidates = 100
+
+	// discoveryInterval is how often the server scans each host announced on
+	// the blockchain.
+	discoveryInterval = 6 * time.Hour
+)
+
+// announcedHosts returns the public keys of every host announced on the
+// blockchain. shard can only look up hosts by key prefix, so the keys are
+// enumerated by walking the prefix tree, descending into each prefix that
+// shard reports as ambiguous.
+func (s *server) announcedHosts() ([]hostdb.HostPublicKey, error) {
+	var hostKeys []hostdb.HostPublicKey
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		for _, c := range "0123456789abcdef" {
+			p := prefix + string(c)
+			resp, err := http.Get(fmt.Sprintf("%v/host/ed25519:%v", s.shardAddr, p))
+			if err != nil {
+				return err
+			}
+			var ha modules.HostAnnouncement
+			switch resp.StatusCode {
+			case http.StatusNoContent:
+			case http.StatusGone:
+				err = walk(p)
+			case http.StatusOK:
+				if err = encoding.NewDecoder(resp.Body, encoding.DefaultAllocLimit).Decode(&ha); err == nil {
+					hostKeys = append(hostKeys, hostdb.HostKeyFromSiaPublicKey(ha.PublicKey))
+				}
+			default:
+				err = fmt.Errorf("shard returned %v", resp.Status)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	return hostKeys, err
+}
+
+// discoverHosts scans each host announced on the blockchain that has not been
+// scanned within discoveryInterval, so that it can be recommended.
+func (s *server) discoverHosts() {
+	announced, err := s.announcedHosts()
+	if err != nil {
+		s.log.Warn("could not enumerate announced hosts", "err", err)
+		return
+	}
+	var stale []hostdb.HostPublicKey
+	s.mu.Lock()
+	for _, hostKey := range announced {
+		if info, ok := s.hosts[hostKey]; !ok || time.Since(info.LastScan) > discoveryInterval {
+			stale = append(stale, hostKey)
+		}
+	}
+	s.mu.Unlock()
+	forEachHost(stale, func(hostKey hostdb.HostPublicKey) HostResult {
+		s.scanHost(hostKey) // errors are recorded
+		return HostResult{HostKey: hostKey}
+	})
+}
+
+// ratio returns a/b as a float64. It returns 1 if b is zero.
+func ratio(a, b *big.Int) float64 {
+	if b.Sign() == 0 {
+		return 1
+	}
+	f, _ := new(big.Rat).SetFrac(a, b).Float64()
+	return f
+}
+
+// scoreHosts scores each host relative to the others, returning the scores in
+// descending order. Each component score is between 0 and 1, and the overall
+// score is their product, so a host must do well in every category to rank
+// highly.
+func scoreHosts(infos []HostInfo, target FundsTarget, height, duration types.BlockHeight) []HostScore {
+	if len(infos) == 0 {
+		return nil
+	}
+	costs := make([]types.Currency, len(infos))
+	collateralRatios := make([]float64, len(infos))
+	var minCost types.Currency
+	var maxRatio float64
+	var minLatency time.Duration
+	for i, info := range infos {
+		costs[i] = EstimateFunds(info.Settings, target, height, duration).TotalCost
+		if i == 0 || costs[i].Cmp(minCost) < 0 {
+			minCost = costs[i]
+		}
+		collateralRatios[i] = ratio(info.Settings.Collateral.Big(), info.Settings.StoragePrice.Big())
+		if collateralRatios[i] > maxRatio {
+			maxRatio = collateralRatios[i]
+		}
+		if i == 0 || info.AverageLatency < minLatency {
+			minLatency = info.AverageLatency
+		}
+	}
+
+	scores := make([]HostScore, len(infos))
+	for i, info := range infos {
+		hs := HostScore{
+			HostKey:         info.PublicKey,
+			Cost:            costs[i],
+			PriceScore:      ratio(minCost.Big(), costs[i].Big()),
+			CollateralScore: 1,
+			UptimeScore:     info.Uptime(),
+			LatencyScore:    1,
+			StorageScore:    1,
+		}
+		if maxRatio > 0 {
+			hs.CollateralScore = collateralRatios[i] / maxRatio
+		}
+		if info.AverageLatency > 0 {
+			hs.LatencyScore = float64(minLatency) / float64(info.AverageLatency)
+		}
+		if target.Storage > 0 {
+			hs.StorageScore = float64(info.Settings.RemainingStorage) / float64(target.Storage*storageHeadroom)
+			if hs.StorageScore > 1 {
+				hs.StorageScore = 1
+			}
+		}
+		hs.Score = hs.PriceScore * hs.CollateralScore * hs.UptimeScore * hs.LatencyScore * hs.StorageScore
+		scores[i] = hs
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].HostKey < scores[j].HostKey
+	})
+	return scores
+}
+
+// recommendHosts returns the best hosts for the specified tenant, according to
+// rr. The candidates are the hosts we have scanned before (which, via
+// discoverHosts, include the hosts announced on the blockchain), plus any
+// supplied by the caller. Caller-supplied candidates without a recent
+// successful scan are rescanned first; the rest are kept fresh by the monitor
+// loop.
+func (s *server) recommendHosts(tenant string, rr RequestRecommend, height types.BlockHeight) []HostScore {
+	exclude := make(map[hostdb.HostPublicKey]bool)
+	for _, hostKey := range rr.Exclude {
+		exclude[hostKey] = true
+	}
+	seen := make(map[hostdb.HostPublicKey]bool)
+	var candidates, stale []hostdb.HostPublicKey
+	s.mu.Lock()
+	known := make([]hostdb.HostPublicKey, 0, len(s.hosts))
+	for hostKey := range s.hosts {
+		known = append(known, hostKey)
+	}
+	for i, hostKey := range append(rr.Candidates[:len(rr.Candidates):len(rr.Candidates)], known...) {
+		if seen[hostKey] || exclude[hostKey] {
+			continue
+		}
+		seen[hostKey] = true
+		candidates = append(candidates, hostKey)
+		supplied := i < len(rr.Candidates)
+		if info, ok := s.hosts[hostKey]; supplied && (!ok || info.LastSuccess.IsZero() || time.Since(info.LastSuccess) > scanCacheTTL) {
+			stale = append(stale, hostKey)
+		}
+	}
+	s.mu.Unlock()
+	forEachHost(stale, func(hostKey hostdb.HostPublicKey) HostResult {
+		s.scanHost(hostKey) // errors are recorded
+		return HostResult{HostKey: hostKey}
+	})
+
+	// discard hosts that don't satisfy our constraints
+	var infos []HostInfo
+	for _, hostKey := range candidates {
+		s.mu.Lock()
+		info, ok := s.hosts[hostKey]
+		s.mu.Unlock()
+		host := hostdb.ScannedHost{HostSettings: info.Settings, PublicKey: hostKey}
+		if !ok || info.LastError != "" || info.LastSuccess.IsZero() ||
+			!info.Settings.AcceptingContracts ||
+			info.Uptime() < rr.MinUptime ||
+			info.Settings.RemainingStorage < rr.Target.Storage ||
+			s.checkPrices(tenant, host) != nil ||
+			s.checkHostRules(tenant, hostKey) != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	scores := scoreHosts(infos, rr.Target, height, rr.Duration)
+	if len(scores) > rr.Count {
+		scores = scores[:rr.Count]
+	}
+	return scores
+}
+
+func (s *server) handleRecommend(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var rr RequestRecommend
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rr.Count <= 0 {
+		writeError(w, "Count must be positive", http.StatusBadRequest)
+		return
+	} else if len(rr.Candidates) > maxRecommendCandidates {
+		writeError(w, fmt.Sprintf("Too many candidates (at most %v are allowed)", maxRecommendCandidates), http.StatusBadRequest)
+		return
+	}
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		writeError(w, "Could not determine chain height: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s.recommendHosts(requestTenant(req), rr, height))
+}
@@ -0,0 +1,135 @@
+package muse
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"go.sia.tech/siad/types"
+)
+
+func (s *server) handleRefresh(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var rr RequestRefresh
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+	var old Contract
+	var err error
+	funds := rr.Funds
+	s.mu.Lock()
+	for _, old = range s.contracts {
+		if old.ID == rr.ID {
+			break
+		}
+	}
+	if old.ID == rr.ID && funds.IsZero() {
+		funds, err = s.renewalFunds(old, FundsSame, funds, rr.StartHeight, old.EndHeight)
+	}
+	s.mu.Unlock()
+	if old.ID != rr.ID || !canAccess(req, old.Tenant) {
+		writeErrorKind(w, "no record of that contract", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	} else if old.RenewedTo != (types.FileContractID{}) {
+		writeError(w, errAlreadyRenewed.Error(), http.StatusBadRequest)
+		return
+	} else if !isActive(old, rr.StartHeight) {
+		writeError(w, "Contract has expired", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log := s.reqLog(req)
+	if err := s.checkHostRules(old.Tenant, old.HostKey); err != nil {
+		log.Info("rejected contract refresh", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "err", err)
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	host, err := s.scanHost(old.HostKey)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkPrices(old.Tenant, host); err != nil {
+		log.Info("rejected contract refresh", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := s.reserveBudget(old.Tenant, host, &old, funds, rr.StartHeight, old.EndHeight)
+	if err != nil {
+		log.Info("rejected contract refresh", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "funds", funds, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer release()
+	ae := newAuditEntry(req, "renew", "", "", "", nil, nil)
+	c, err := s.renewContract(log, ae, old, host, funds, rr.StartHeight, old.EndHeight)
+	if err == errAlreadyRenewed {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeErrorKind(w, err.Error(), http.StatusInternalServerError, contractErrorKind(err))
+		return
+	}
+	writeJSON(w, c)
+}
+
+// autoRefresh fetches the latest revision of each contract whose host set has
+// a refresh threshold, and refreshes the contracts whose remaining funds have
+// fallen below it. Contracts within the renew window are left to autoRenew.
+func (s *server) autoRefresh(height types.BlockHeight) {
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+
+	type refresh struct {
+		contract Contract
+		policy   RenewPolicy
+	}
+	var refreshes []refresh
+	s.mu.Lock()
+	setNames := make([]string, 0, len(s.renewPolicies))
+	for name, policy := range s.renewPolicies {
+		if !policy.RefreshThreshold.IsZero() {
+			setNames = append(setNames, name)
+		}
+	}
+	sort.Strings(setNames)
+	// as in autoRenew, the first policy (by set name) wins
+	seen := make(map[types.FileContractID]bool)
+	for _, name := range setNames {
+		policy := s.renewPolicies[name]
+		contracts, _ := s.activeContracts(name)
+		for _, c := range contracts {
+			if !seen[c.ID] && c.EndHeight > height+policy.Window {
+				seen[c.ID] = true
+				refreshes = append(refreshes, refresh{c, policy})
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	log := s.log.With("autoRefresh", true)
+	for _, r := range refreshes {
+		c, err := s.updateRevision(r.contract, height)
+		if err != nil {
+			log.Warn("could not fetch contract revision", "contractID", r.contract.ID, "hostKey", r.contract.HostKey, "err", err)
+			continue
+		} else if c.RenterFunds.Cmp(r.policy.RefreshThreshold) >= 0 {
+			continue
+		}
+		log.Info("contract funds below refresh threshold", "contractID", c.ID, "hostKey", c.HostKey, "renterFunds", c.RenterFunds, "threshold", r.policy.RefreshThreshold)
+		if _, err := s.autoRenewContract(log, "autorefresh", c, r.policy.Funds, height, c.EndHeight); err != nil {
+			s.metrics.inc(&s.metrics.autoRenewFailures)
+			log.Warn("could not auto-refresh contract", "contractID", c.ID, "hostKey", c.HostKey, "height", height, "err", err)
+			s.notifyRenewFailed(c, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package muse
+
+import (
+	"sync"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// resolveConcurrency is the maximum number of host keys resolved in parallel
+// when serving /contracts.
+const resolveConcurrency = 8
+
+// An addrCache caches the resolved addresses of hosts. A host can only change
+// its address by announcing, and announcements only take effect in new blocks,
+// so a cached address is fresh until the chain height changes. Stale addresses
+// are retained as a fallback in case resolution fails.
+type addrCache struct {
+	mu      sync.Mutex
+	entries map[hostdb.HostPublicKey]cachedAddr
+}
+
+type cachedAddr struct {
+	addr   modules.NetAddress
+	height types.BlockHeight
+}
+
+// get returns the cached address of the host, and whether it was resolved at
+// the specified height.
+func (ac *addrCache) get(hostKey hostdb.HostPublicKey, height types.BlockHeight) (modules.NetAddress, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	e, ok := ac.entries[hostKey]
+	return e.addr, ok && e.height == height
+}
+
+func (ac *addrCache) put(hostKey hostdb.HostPublicKey, addr modules.NetAddress, height types.BlockHeight) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.entries == nil {
+		ac.entries = make(map[hostdb.HostPublicKey]cachedAddr)
+	}
+	ac.entries[hostKey] = cachedAddr{addr, height}
+}
+
+// resolveAddresses fills in the HostAddress of each contract. Each distinct
+// host is resolved at most once, in parallel, using the cache where possible.
+// If a host cannot be resolved, its last known address is used, and the
+// contract's AddressError is set.
+func (s *server) resolveAddresses(cs []Contract) {
+	// if the height is unavailable, treat every cached address as stale
+	height, heightErr := s.shard.ChainHeight()
+
+	type result struct {
+		addr modules.NetAddress
+		err  error
+	}
+	results := make(map[hostdb.HostPublicKey]result)
+	var stale []hostdb.HostPublicKey
+	for _, c := range cs {
+		if _, ok := results[c.HostKey]; ok {
+			continue
+		}
+		addr, fresh := s.addrs.get(c.HostKey, height)
+		if fresh && heightErr == nil {
+			s.metrics.inc(&s.metrics.resolveCacheHits)
+		} else {
+			stale = append(stale, c.HostKey)
+		}
+		results[c.HostKey] = result{addr: addr}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, resolveConcurrency)
+	for _, hostKey := range stale {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(hostKey hostdb.HostPublicKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			addr, err := s.resolveHostKey(hostKey)
+			if err == nil && heightErr == nil {
+				s.addrs.put(hostKey, addr, height)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				results[hostKey] = result{results[hostKey].addr, err}
+			} else {
+				results[hostKey] = result{addr, nil}
+			}
+		}(hostKey)
+	}
+	wg.Wait()
+
+	for i := range cs {
+		r := results[cs[i].HostKey]
+		if r.addr != "" {
+			cs[i].HostAddress = r.addr
+		}
+		if r.err != nil {
+			cs[i].AddressError = r.err.Error()
+		}
+	}
+}
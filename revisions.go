@@ -0,0 +1,103 @@
+package muse
+
+import (
+	"errors"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/renter/proto"
+)
+
+const (
+	// revisionInterval is how often the server checks for contracts whose
+	// revisions are stale.
+	revisionInterval = time.Hour
+
+	// revisionMaxAge is how long a fetched revision is considered fresh.
+	// Each fetch locks the contract, so contracts are not fetched any more
+	// often than this.
+	revisionMaxAge = 6 * time.Hour
+)
+
+func (s *server) revisionLoop() {
+	t := time.NewTicker(revisionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		height, err := s.shard.ChainHeight()
+		if err != nil {
+			s.log.Warn("could not determine chain height for revision update", "err", err)
+			continue
+		}
+		s.updateRevisions(height)
+	}
+}
+
+// updateRevisions fetches and records the latest revision of each contract
+// that has neither expired nor been renewed, and whose revision has not been
+// fetched within revisionMaxAge.
+func (s *server) updateRevisions(height types.BlockHeight) {
+	s.mu.Lock()
+	ids := make(map[types.FileContractID]struct{}, len(s.contracts))
+	for _, c := range s.contracts {
+		ids[c.ID] = struct{}{}
+	}
+	var active []Contract
+	for _, c := range s.contracts {
+		if _, renewed := ids[c.RenewedTo]; !renewed && isActive(c, height) && time.Since(c.LastSeen) >= revisionMaxAge {
+			active = append(active, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range active {
+		if _, err := s.updateRevision(c, height); errors.Is(err, proto.ErrContractLocked) {
+			// the contract is in use; try again next time
+			s.log.Debug("contract is locked, skipping revision update", "contractID", c.ID, "hostKey", c.HostKey)
+		} else if err != nil {
+			s.log.Warn("could not fetch contract revision", "contractID", c.ID, "hostKey", c.HostKey, "err", err)
+		}
+	}
+}
+
+// updateRevision fetches and records the latest revision of c, returning the
+// updated contract.
+func (s *server) updateRevision(c Contract, height types.BlockHeight) (Contract, error) {
+	hostAddr, err := s.resolveHostKey(c.HostKey)
+	if err != nil {
+		return Contract{}, err
+	}
+	sess, err := proto.NewSession(hostAddr, c.HostKey, c.ID, c.RenterKey, height)
+	if err != nil {
+		return Contract{}, err
+	}
+	rev := sess.Revision()
+	sess.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the contract may have been modified or deleted in the meantime
+	for i := range s.contracts {
+		if s.contracts[i].ID != c.ID {
+			continue
+		}
+		c := s.contracts[i]
+		c.RenterFunds = rev.RenterFunds()
+		c.NewFileSize = rev.Revision.NewFileSize
+		c.RevisionNumber = rev.Revision.NewRevisionNumber
+		c.LastSeen = time.Now()
+		err := s.store.Update(func(tx Tx) error {
+			return s.putContract(tx, c)
+		})
+		if err == nil {
+			s.contracts[i] = c
+			s.log.Debug("updated contract revision", "contractID", c.ID, "hostKey", c.HostKey, "revisionNumber", c.RevisionNumber, "renterFunds", c.RenterFunds, "fileSize", c.NewFileSize)
+		}
+		return c, err
+	}
+	return Contract{}, errors.New("contract no longer exists")
+}
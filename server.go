@@ -2,11 +2,11 @@ package muse
 
 import (
 	"context"
+	"crypto/cipher"
 	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -18,13 +18,15 @@ import (
 	"sync"
 	"time"
 
-	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/crypto"
 	"go.sia.tech/siad/types"
 	"lukechampine.com/frand"
 	"lukechampine.com/shard"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
 )
 
 func writeJSON(w http.ResponseWriter, v interface{}) {
@@ -39,106 +41,294 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	enc.Encode(v)
 }
 
-type server struct {
-	contracts []Contract
-	hostSets  map[string][]hostdb.HostPublicKey
-	dir       string
-
-	wallet proto.Wallet
-	tpool  proto.TransactionPool
-	shard  *shard.Client
-	mu     sync.Mutex
-	utxoMu sync.Mutex // separate mutex for utxos, preventing reuse
+// writeError writes a JSON-encoded ResponseError with the specified message and
+// status code, inferring the kind of error from the code.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	writeErrorKind(w, msg, code, "")
 }
 
-func (s *server) saveContract(c Contract) error {
-	path := filepath.Join(s.dir, fmt.Sprintf("%s-%x.contract", c.HostKey.ShortKey(), c.ID[:4]))
-	js, _ := json.MarshalIndent(c, "", "  ")
-	return ioutil.WriteFile(path, js, 0660)
+// writeErrorKind is like writeError, but reports the specified kind of error.
+// If kind is empty, it is inferred from code.
+func writeErrorKind(w http.ResponseWriter, msg string, code int, kind string) {
+	if kind == "" {
+		kind = statusErrorKind(code)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ResponseError{Error: msg, Kind: kind})
+}
+
+// statusErrorKind returns the kind of error implied by an HTTP status code.
+func statusErrorKind(code int) string {
+	switch {
+	case code == http.StatusUnauthorized:
+		return ErrorKindUnauthorized
+	case code == http.StatusForbidden:
+		return ErrorKindForbidden
+	case code == http.StatusNotFound:
+		return ErrorKindNotFound
+	case code >= 500:
+		return ErrorKindInternal
+	default:
+		return ErrorKindBadRequest
+	}
 }
 
-func (s *server) deleteContract(c Contract) error {
-	path := filepath.Join(s.dir, fmt.Sprintf("%s-%x.contract", c.HostKey.ShortKey(), c.ID[:4]))
-	return os.RemoveAll(path)
+// contractErrorKind classifies an error encountered while forming or renewing
+// a contract, returning the empty string if the error is not recognized.
+func contractErrorKind(err error) string {
+	if errors.As(err, new(*renterhost.RPCError)) {
+		return ErrorKindHostRejected
+	}
+	// remote wallets, e.g. walrus, report insufficient funds as plain text
+	if errors.Is(err, wallet.ErrInsufficientFunds) || strings.Contains(err.Error(), wallet.ErrInsufficientFunds.Error()) {
+		return ErrorKindInsufficientFunds
+	}
+	return ""
+}
+
+type server struct {
+	contracts         []Contract
+	archive           []Contract
+	hostSets          map[string][]hostdb.HostPublicKey
+	renewPolicies     map[string]RenewPolicy
+	budgets           map[string]Budget
+	priceLimits       PriceLimits
+	setPriceLimits    map[string]PriceLimits
+	hostRules         map[string]HostRule
+	healPolicies      map[string]HealPolicy
+	ledger            []LedgerEntry
+	budgetReserved    map[*LedgerEntry]struct{}
+	renewing          map[types.FileContractID]bool
+	hosts             map[hostdb.HostPublicKey]HostInfo
+	addrs             addrCache
+	metrics           metrics
+	log               *Logger
+	webhooks          map[string]Webhook
+	webhookDeliveries map[string][]WebhookDelivery
+	expiryNotified    map[types.FileContractID]bool
+	renewFailNotified map[types.FileContractID]bool
+	subscribers       map[*subscriber]struct{}
+	tenants           map[string]crypto.Hash
+	hostSetOwners     map[string]string
+	adminKey          string
+	aead              cipher.AEAD
+	store             Store
+	dir               string
+	shardAddr         string
+	ctx               context.Context
+	mux               *http.ServeMux
+
+	wallet  proto.Wallet
+	tpool   proto.TransactionPool
+	shard   *shard.Client
+	mu      sync.Mutex
+	utxoMu  sync.Mutex // separate mutex for utxos, preventing reuse
+	renewMu sync.Mutex // serializes renewals and host replacements
+	eventMu sync.Mutex // protects webhooks, webhookDeliveries, and subscribers; acquired after mu
+}
+
+// activeContracts returns the most recent contract for each host in the named
+// host set. Only contracts belonging to the owner of the host set are
+// considered. The caller must hold s.mu.
+func (s *server) activeContracts(setName string) ([]Contract, bool) {
+	hostKeys, ok := s.hostSets[setName]
+	if !ok {
+		return nil, false
+	}
+	owner := s.hostSetOwners[setName]
+	ids := make(map[types.FileContractID]struct{}, len(s.contracts))
+	for _, c := range s.contracts {
+		ids[c.ID] = struct{}{}
+	}
+	// take the latest renewal of each contract; if there are multiple
+	// lineages for a host, take the one with the highest end height
+	set := make(map[hostdb.HostPublicKey]Contract)
+	for _, hostKey := range hostKeys {
+		set[hostKey] = Contract{}
+	}
+	for _, c := range s.contracts {
+		if _, renewed := ids[c.RenewedTo]; renewed {
+			continue
+		}
+		if d, ok := set[c.HostKey]; ok && c.Tenant == owner && c.EndHeight > d.EndHeight {
+			set[c.HostKey] = c
+		}
+	}
+	contracts := make([]Contract, 0, len(set))
+	for _, c := range set {
+		if c.RenterKey != nil {
+			contracts = append(contracts, c)
+		}
+	}
+	return contracts, true
 }
 
 func (s *server) handleContracts(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodGet {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	var contracts responseContracts
-	if setName := req.FormValue("hostset"); setName != "" {
-		s.mu.Lock()
-		hostKeys, ok := s.hostSets[setName]
-		if !ok {
-			s.mu.Unlock()
-			http.Error(w, "No record of that host set", http.StatusBadRequest)
+	q, err := parseContractQuery(req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var height types.BlockHeight
+	if q.Status != "" {
+		if height, err = s.shard.ChainHeight(); err != nil {
+			writeError(w, "Could not determine chain height: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// take most recent contract for each host
-		set := make(map[hostdb.HostPublicKey]Contract)
-		for _, hostKey := range hostKeys {
-			set[hostKey] = Contract{}
-		}
-		for _, c := range s.contracts {
-			if d, ok := set[c.HostKey]; ok && c.EndHeight > d.EndHeight {
-				set[c.HostKey] = c
-			}
+	}
+
+	var contracts []Contract
+	if q.Archived {
+		if q.HostSet != "" {
+			writeError(w, "Archived contracts cannot be filtered by host set", http.StatusBadRequest)
+			return
 		}
-		contracts = make([]Contract, 0, len(set))
-		for _, c := range set {
-			if c.RenterKey != nil {
+		s.mu.Lock()
+		for _, c := range s.archive {
+			if canAccess(req, c.Tenant) {
 				contracts = append(contracts, c)
 			}
 		}
 		s.mu.Unlock()
+	} else if q.HostSet != "" {
+		s.mu.Lock()
+		set, ok := s.activeContracts(q.HostSet)
+		ok = ok && canAccess(req, s.hostSetOwners[q.HostSet])
+		s.mu.Unlock()
+		if !ok {
+			writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		contracts = set
 	} else {
 		s.mu.Lock()
-		contracts = append([]Contract(nil), s.contracts...)
+		for _, c := range s.contracts {
+			if canAccess(req, c.Tenant) {
+				contracts = append(contracts, c)
+			}
+		}
 		s.mu.Unlock()
 	}
 
-	// fill in addresses
-	for i := range contracts {
-		addr, err := s.shard.ResolveHostKey(contracts[i].HostKey)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		contracts[i].HostAddress = addr
+	// only resolve the addresses of the contracts actually returned
+	page, next := queryContracts(contracts, q, height)
+	s.resolveAddresses(page)
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
 	}
-	writeJSON(w, contracts)
+	writeJSON(w, responseContracts(page))
 }
 
 func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	var rf RequestForm
 	if err := json.NewDecoder(req.Body).Decode(&rf); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	hostAddr, err := s.shard.ResolveHostKey(rf.HostKey)
+	hostAddr, err := s.resolveHostKey(rf.HostKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenant := requestTenant(req)
+	if err := s.checkHostRules(tenant, rf.HostKey); err != nil {
+		s.reqLog(req).Info("rejected contract formation", "hostKey", rf.HostKey, "tenant", tenant, "err", err)
+		writeError(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	rf.Settings.NetAddress = hostAddr
 	host := hostdb.ScannedHost{
 		HostSettings: rf.Settings,
 		PublicKey:    rf.HostKey,
 	}
+	if rf.Target != nil || s.needsScan(tenant, rf.HostKey) {
+		// the client's settings can't be trusted to satisfy the limits, or
+		// to estimate the funds from
+		if host, err = s.scanHost(rf.HostKey); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	host.NetAddress = hostAddr
+	funds, estimate, err := requestFunds(rf.Funds, rf.Target, host.HostSettings, nil, rf.StartHeight, rf.EndHeight)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkPrices(tenant, host); err != nil {
+		s.reqLog(req).Info("rejected contract formation", "hostKey", rf.HostKey, "tenant", tenant, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := s.reserveBudget(tenant, host, nil, funds, rf.StartHeight, rf.EndHeight)
+	if err != nil {
+		s.reqLog(req).Info("rejected contract formation", "hostKey", rf.HostKey, "tenant", tenant, "funds", funds, "startHeight", rf.StartHeight, "endHeight", rf.EndHeight, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer release()
+	ae := newAuditEntry(req, "form", "", "", "", nil, nil)
+	c, err := s.formContract(s.reqLog(req), ae, tenant, host, funds, rf.StartHeight, rf.EndHeight)
+	if err != nil {
+		writeErrorKind(w, err.Error(), http.StatusInternalServerError, contractErrorKind(err))
+		return
+	}
+	writeJSON(w, ResponseForm{c, estimate})
+}
+
+// formContract forms a contract with the specified host on behalf of tenant,
+// records it, and returns it. The formation is recorded in the audit log using
+// ae, which should identify the caller.
+func (s *server) formContract(log *Logger, ae AuditEntry, tenant string, host hostdb.ScannedHost, funds types.Currency, start, end types.BlockHeight) (Contract, error) {
 	key := ed25519.NewKeyFromSeed(frand.Bytes(32))
+	c := Contract{
+		Contract: renter.Contract{
+			HostKey:   host.PublicKey,
+			RenterKey: key,
+		},
+		HostAddress: host.NetAddress,
+		EndHeight:   end,
+		Tenant:      tenant,
+	}
+	log = log.With("hostKey", host.PublicKey, "tenant", tenant, "funds", funds, "startHeight", start, "endHeight", end)
+
+	// record the key before forming the contract, so that it is not lost if
+	// the server crashes before the contract can be recorded
+	pendingKey := []byte(key.Public().(ed25519.PublicKey))
+	err := s.store.Update(func(tx Tx) error {
+		return s.putSealedJSON(tx, bucketPending, pendingKey, c)
+	})
+	if err != nil {
+		return Contract{}, err
+	}
+	deletePending := func(tx Tx) error { return tx.Delete(bucketPending, pendingKey) }
+
+	// the ledger records the chain height, not the requested start height
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		s.store.Update(deletePending)
+		return Contract{}, fmt.Errorf("could not determine chain height: %w", err)
+	}
+
 	s.utxoMu.Lock()
-	rev, txnSet, err := proto.FormContract(s.wallet, s.tpool, key, host, rf.Funds, rf.StartHeight, rf.EndHeight)
+	formStart := time.Now()
+	rev, txnSet, err := proto.FormContract(s.wallet, s.tpool, key, host, funds, start, end)
+	s.metrics.observe("form", formStart, err)
 	if err != nil {
 		s.utxoMu.Unlock()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		s.store.Update(deletePending)
+		log.Warn("contract formation failed", "err", err)
+		return Contract{}, err
 	}
 
 	// submit txnSet to tpool
@@ -149,42 +339,55 @@ func (s *server) handleForm(w http.ResponseWriter, req *http.Request) {
 	// tpool without error, and intend to honor the contract. Our tpool
 	// *shouldn't* reject the transaction, but it might if we desync from
 	// the network somehow.
-	submitErr := s.tpool.AcceptTransactionSet(txnSet)
+	c.ID = rev.ID()
+	log = log.With("contractID", c.ID)
+	s.acceptTransactionSet(log, txnSet)
 	s.utxoMu.Unlock()
-	if submitErr != nil && submitErr != modules.ErrDuplicateTransactionSet {
-		log.Println("WARN: contract transaction was not accepted", submitErr)
-	}
 
-	c := Contract{
-		Contract: renter.Contract{
-			HostKey:   rev.HostKey(),
-			ID:        rev.ID(),
-			RenterKey: key,
-		},
-		HostAddress: host.NetAddress,
-		EndHeight:   rf.EndHeight,
-	}
+	entry := newLedgerEntry("form", c, host, funds, height, txnSet)
+	ae.Action = "form"
+	ae.Target = c.ID.String()
+	ae.Tenant = c.Tenant
+	ae.Summary = fmt.Sprintf("formed contract with host %v (funds %v, end height %v)", c.HostKey, funds.HumanString(), c.EndHeight)
+	ae.After = auditState(newAuditContract(c))
 	s.mu.Lock()
-	s.contracts = append(s.contracts, c)
+	err = s.store.Update(func(tx Tx) error {
+		if err := deletePending(tx); err != nil {
+			return err
+		} else if err := putJSON(tx, bucketLedger, c.ID[:], entry); err != nil {
+			return err
+		} else if err := s.putAudit(tx, ae); err != nil {
+			return err
+		}
+		return s.putContract(tx, c)
+	})
+	if err == nil {
+		s.contracts = append(s.contracts, c)
+		s.ledger = append(s.ledger, entry)
+	}
 	s.mu.Unlock()
-	err = s.saveContract(c)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Error("could not record formed contract", "err", err)
+		return Contract{}, err
 	}
-	writeJSON(w, c)
+	log.Info("formed contract", "cost", entry.Total())
+	s.notifyContract(EventForm, c, nil)
+	return c, nil
 }
 
 func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	var rf RequestRenew
 	if err := json.NewDecoder(req.Body).Decode(&rf); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// prevent automatic renewals from racing with this one
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
 	var old Contract
 	s.mu.Lock()
 	for _, old = range s.contracts {
@@ -193,35 +396,115 @@ func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 	s.mu.Unlock()
-	if old.ID != rf.ID {
-		http.Error(w, "no record of that contract", http.StatusBadRequest)
+	if old.ID != rf.ID || !canAccess(req, old.Tenant) {
+		writeErrorKind(w, "no record of that contract", http.StatusBadRequest, ErrorKindNotFound)
+		return
+	} else if old.RenewedTo != (types.FileContractID{}) {
+		writeError(w, errAlreadyRenewed.Error(), http.StatusBadRequest)
 		return
 	}
 
-	hostAddr, err := s.shard.ResolveHostKey(old.HostKey)
+	hostAddr, err := s.resolveHostKey(old.HostKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkHostRules(old.Tenant, old.HostKey); err != nil {
+		s.reqLog(req).Info("rejected contract renewal", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "err", err)
+		writeError(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	rf.Settings.NetAddress = hostAddr
 	host := hostdb.ScannedHost{
 		PublicKey:    old.HostKey,
 		HostSettings: rf.Settings,
 	}
+	if rf.Target != nil || s.needsScan(old.Tenant, old.HostKey) {
+		// the client's settings can't be trusted to satisfy the limits, or
+		// to estimate the funds from
+		if host, err = s.scanHost(old.HostKey); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	host.NetAddress = hostAddr
+	funds, estimate, err := requestFunds(rf.Funds, rf.Target, host.HostSettings, &old, rf.StartHeight, rf.EndHeight)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkPrices(old.Tenant, host); err != nil {
+		s.reqLog(req).Info("rejected contract renewal", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := s.reserveBudget(old.Tenant, host, &old, funds, rf.StartHeight, rf.EndHeight)
+	if err != nil {
+		s.reqLog(req).Info("rejected contract renewal", "contractID", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "funds", funds, "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer release()
+	ae := newAuditEntry(req, "renew", "", "", "", nil, nil)
+	c, err := s.renewContract(s.reqLog(req), ae, old, host, funds, rf.StartHeight, rf.EndHeight)
+	if err == errAlreadyRenewed {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeErrorKind(w, err.Error(), http.StatusInternalServerError, contractErrorKind(err))
+		return
+	}
+	writeJSON(w, ResponseForm{c, estimate})
+}
+
+// errAlreadyRenewed is returned when renewing a contract that has already been
+// renewed, or is being renewed.
+var errAlreadyRenewed = errors.New("Contract has already been renewed")
+
+// renewContract renews the old contract with the specified host, records the
+// resulting contract, and returns it. The renewal is recorded in the audit log
+// using ae, which should identify the caller.
+func (s *server) renewContract(log *Logger, ae AuditEntry, old Contract, host hostdb.ScannedHost, funds types.Currency, start, end types.BlockHeight) (Contract, error) {
+	log = log.With("renewedFrom", old.ID, "hostKey", old.HostKey, "tenant", old.Tenant, "funds", funds, "startHeight", start, "endHeight", end)
+	// claim the old contract, so that concurrent callers cannot both renew it
+	s.mu.Lock()
+	renewed := s.renewing[old.ID] || old.RenewedTo != (types.FileContractID{})
+	for _, c := range s.contracts {
+		if c.ID == old.ID && c.RenewedTo != (types.FileContractID{}) {
+			renewed = true
+		}
+	}
+	if !renewed {
+		s.renewing[old.ID] = true
+	}
+	s.mu.Unlock()
+	if renewed {
+		return Contract{}, errAlreadyRenewed
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.renewing, old.ID)
+		s.mu.Unlock()
+	}()
+
+	// the ledger records the chain height, not the requested start height
+	height, err := s.shard.ChainHeight()
+	if err != nil {
+		return Contract{}, fmt.Errorf("could not determine chain height: %w", err)
+	}
 	s.utxoMu.Lock()
-	rev, txnSet, err := proto.RenewContract(s.wallet, s.tpool, old.ID, old.RenterKey, host, rf.Funds, rf.StartHeight, rf.EndHeight)
+	renewStart := time.Now()
+	rev, txnSet, err := proto.RenewContract(s.wallet, s.tpool, old.ID, old.RenterKey, host, funds, start, end)
+	s.metrics.observe("renew", renewStart, err)
 	if err != nil {
 		s.utxoMu.Unlock()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Warn("contract renewal failed", "err", err)
+		return Contract{}, err
 	}
+	log = log.With("contractID", rev.ID())
 
 	// submit txnSet to tpool (see handleForm)
-	submitErr := s.tpool.AcceptTransactionSet(txnSet)
+	s.acceptTransactionSet(log, txnSet)
 	s.utxoMu.Unlock()
-	if submitErr != nil && submitErr != modules.ErrDuplicateTransactionSet {
-		log.Println("WARN: contract transaction was not accepted", submitErr)
-	}
 
 	c := Contract{
 		Contract: renter.Contract{
@@ -229,24 +512,82 @@ func (s *server) handleRenew(w http.ResponseWriter, req *http.Request) {
 			ID:        rev.ID(),
 			RenterKey: old.RenterKey,
 		},
-		HostAddress: rf.Settings.NetAddress,
-		EndHeight:   rf.EndHeight,
+		HostAddress: host.NetAddress,
+		EndHeight:   end,
+		Tenant:      old.Tenant,
+		RenewedFrom: old.ID,
 	}
 	s.mu.Lock()
-	s.contracts = append(s.contracts, c)
-	s.mu.Unlock()
-	err = s.saveContract(c)
+	defer s.mu.Unlock()
+	// link the old contract to the new one
+	oldIndex := -1
+	for i := range s.contracts {
+		if s.contracts[i].ID == old.ID {
+			oldIndex = i
+			old = s.contracts[i]
+			break
+		}
+	}
+	if old.RenewedTo != (types.FileContractID{}) {
+		// the claim above should prevent this; record the new contract anyway,
+		// so that its renter key is not lost, but leave the old link intact
+		log.Error("contract was renewed concurrently", "renewedTo", old.RenewedTo)
+		oldIndex = -1
+	}
+	old.RenewedTo = c.ID
+	entry := newLedgerEntry("renew", c, host, funds, height, txnSet)
+	ae.Action = "renew"
+	ae.Target = old.ID.String()
+	ae.Tenant = old.Tenant
+	ae.Summary = fmt.Sprintf("renewed contract with host %v as %v (funds %v, end height %v)", c.HostKey, c.ID, funds.HumanString(), c.EndHeight)
+	ae.Before = auditState(newAuditContract(old))
+	ae.After = auditState(newAuditContract(c))
+	err = s.store.Update(func(tx Tx) error {
+		if err := putJSON(tx, bucketLedger, c.ID[:], entry); err != nil {
+			return err
+		} else if err := s.putAudit(tx, ae); err != nil {
+			return err
+		}
+		if oldIndex >= 0 {
+			if err := s.putContract(tx, old); err != nil {
+				return err
+			}
+		}
+		return s.putContract(tx, c)
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Error("could not record renewed contract", "err", err)
+		return Contract{}, err
 	}
-	writeJSON(w, c)
+	log.Info("renewed contract", "cost", entry.Total())
+	s.notifyContract(EventRenew, c, nil)
+	if oldIndex >= 0 {
+		s.contracts[oldIndex] = old
+	}
+	s.contracts = append(s.contracts, c)
+	s.ledger = append(s.ledger, entry)
+	return c, nil
 }
 
 func (s *server) handleHostSets(w http.ResponseWriter, req *http.Request) {
 	setName := strings.TrimPrefix(req.URL.Path, "/hostsets/")
-	if strings.Contains(setName, "/") {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	if i := strings.IndexByte(setName, '/'); i >= 0 {
+		switch setName, sub := setName[:i], setName[i+1:]; sub {
+		case "renewpolicy":
+			s.handleRenewPolicy(w, req, setName)
+		case "budget":
+			s.handleBudget(w, req, setName)
+		case "pricelimits":
+			s.handlePriceLimits(w, req, setName)
+		case "healpolicy":
+			s.handleHealPolicy(w, req, setName)
+		case "form":
+			s.handleHostSetForm(w, req, setName)
+		case "renew":
+			s.handleHostSetRenew(w, req, setName)
+		default:
+			writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
 		return
 	}
 
@@ -256,22 +597,25 @@ func (s *server) handleHostSets(w http.ResponseWriter, req *http.Request) {
 			s.mu.Lock()
 			setNames := make([]string, 0, len(s.hostSets))
 			for name := range s.hostSets {
-				setNames = append(setNames, name)
+				if canAccess(req, s.hostSetOwners[name]) {
+					setNames = append(setNames, name)
+				}
 			}
 			s.mu.Unlock()
 			sort.Strings(setNames)
 			writeJSON(w, setNames)
 		} else {
 			if setName == "" {
-				http.Error(w, "No host set name provided", http.StatusBadRequest)
+				writeError(w, "No host set name provided", http.StatusBadRequest)
 				return
 			}
 			s.mu.Lock()
 			set, ok := s.hostSets[setName]
+			ok = ok && canAccess(req, s.hostSetOwners[setName])
 			hostKeys := append([]hostdb.HostPublicKey(nil), set...)
 			s.mu.Unlock()
 			if !ok {
-				http.Error(w, "No record of that host set", http.StatusBadRequest)
+				writeErrorKind(w, "No record of that host set", http.StatusBadRequest, ErrorKindNotFound)
 				return
 			}
 			writeJSON(w, hostKeys)
@@ -279,56 +623,118 @@ func (s *server) handleHostSets(w http.ResponseWriter, req *http.Request) {
 
 	case http.MethodPut:
 		if setName == "" {
-			http.Error(w, "No host set name provided", http.StatusBadRequest)
+			writeError(w, "No host set name provided", http.StatusBadRequest)
 			return
 		}
 
 		var hostKeys []hostdb.HostPublicKey
 		if err := json.NewDecoder(req.Body).Decode(&hostKeys); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		sort.Slice(hostKeys, func(i, j int) bool {
 			return hostKeys[i] < hostKeys[j]
 		})
+		// check host rules before acquiring the lock for the update, since
+		// checking network rules may require resolving host addresses
+		s.mu.Lock()
+		ruleTenant, ok := s.hostSetOwners[setName]
+		if !ok {
+			ruleTenant = requestTenant(req)
+		}
+		s.mu.Unlock()
+		for _, hostKey := range hostKeys {
+			if err := s.checkHostRules(ruleTenant, hostKey); err != nil {
+				writeError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
 		s.mu.Lock()
-		s.hostSets[setName] = hostKeys
-		if len(hostKeys) == 0 {
-			delete(s.hostSets, setName)
+		_, exists := s.hostSets[setName]
+		if exists && !canAccess(req, s.hostSetOwners[setName]) {
+			s.mu.Unlock()
+			writeError(w, "Host set is owned by another tenant", http.StatusForbidden)
+			return
+		}
+		owner := requestTenant(req)
+		if exists {
+			owner = s.hostSetOwners[setName]
+		}
+		var before, after interface{}
+		if exists {
+			before = s.hostSets[setName]
+		}
+		summary := "deleted host set " + setName
+		if len(hostKeys) > 0 {
+			after = hostKeys
+			summary = fmt.Sprintf("set host set %v to %v hosts", setName, len(hostKeys))
+		}
+		ae := newAuditEntry(req, "hostset", setName, owner, summary, before, after)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			key := []byte(setName)
+			if len(hostKeys) == 0 {
+				for _, bucket := range []string{bucketHostSets, bucketHostSetOwners, bucketRenewPolicies, bucketBudgets, bucketPriceLimits, bucketHealPolicies} {
+					if err := tx.Delete(bucket, key); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			if err := putJSON(tx, bucketHostSets, key, hostKeys); err != nil {
+				return err
+			}
+			return tx.Put(bucketHostSetOwners, key, []byte(owner))
+		})
+		if err == nil {
+			s.hostSets[setName] = hostKeys
+			s.hostSetOwners[setName] = owner
+			if len(hostKeys) == 0 {
+				delete(s.hostSets, setName)
+				delete(s.hostSetOwners, setName)
+				delete(s.renewPolicies, setName)
+				delete(s.budgets, setName)
+				delete(s.setPriceLimits, setName)
+				delete(s.healPolicies, setName)
+			}
 		}
-		hostSetsJSON, _ := json.MarshalIndent(s.hostSets, "", "  ")
 		s.mu.Unlock()
-		err := ioutil.WriteFile(filepath.Join(s.dir, "hostSets.json"), hostSetsJSON, 0660)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		s.notify(Event{
+			Type:    EventHostSet,
+			Tenant:  owner,
+			HostSet: setName,
+		})
 
 	default:
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
 func (s *server) handleScan(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	var rs RequestScan
 	if err := json.NewDecoder(req.Body).Decode(&rs); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	hostAddr, err := s.shard.ResolveHostKey(rs.HostKey)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if !rs.Force {
+		if host, ok := s.cachedScan(rs.HostKey); ok {
+			writeJSON(w, host.HostSettings)
+			return
+		}
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	host, err := hostdb.Scan(ctx, hostAddr, rs.HostKey)
+	host, err := s.scanHost(rs.HostKey)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	writeJSON(w, host.HostSettings)
@@ -336,87 +742,110 @@ func (s *server) handleScan(w http.ResponseWriter, req *http.Request) {
 
 func (s *server) handleDelete(w http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 	idStr := strings.TrimPrefix(req.URL.Path, "/delete/")
 	if strings.Contains(idStr, "/") {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 	var id types.FileContractID
 	if err := id.LoadString(idStr); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var c Contract
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i := range s.contracts {
-		if s.contracts[i].ID == id {
-			c = s.contracts[i]
-			s.contracts = append(s.contracts[:i], s.contracts[i+1:]...)
-			break
+		if s.contracts[i].ID == id && canAccess(req, s.contracts[i].Tenant) {
+			c := s.contracts[i]
+			ae := newAuditEntry(req, "delete", id.String(), c.Tenant, "archived contract with host "+string(c.HostKey), newAuditContract(c), nil)
+			if err := s.archiveContract(i, ae); err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.reqLog(req).Info("deleted contract", "contractID", id)
+			s.notifyContract(EventDelete, c, nil)
+			return
 		}
 	}
-	s.mu.Unlock()
-	if c.ID == (types.FileContractID{}) {
-		return // contract not found
-	}
-	if err := s.deleteContract(c); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// contract not found
+}
+
+// WithContext causes the server's background loops (automatic renewal, revision
+// updates, host monitoring, and archival) to exit when ctx is done. By default,
+// they run for the lifetime of the process.
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *server) {
+		s.ctx = ctx
 	}
 }
 
-// NewServer returns an HTTP handler that serves the muse API.
-func NewServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, shardAddr string) (http.Handler, error) {
+func newServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, shardAddr string, opts ...ServerOption) (*server, error) {
 	srv := &server{
-		wallet: wallet,
-		tpool:  tpool,
-		shard:  shard.NewClient(shardAddr),
-		dir:    dir,
+		wallet:    wallet,
+		tpool:     tpool,
+		shard:     shard.NewClient(shardAddr),
+		shardAddr: shardAddr,
+		dir:       dir,
+		log:       NewLogger(os.Stderr, LogfmtFormat, LevelInfo),
+
+		ctx:               context.Background(),
+		expiryNotified:    make(map[types.FileContractID]bool),
+		renewFailNotified: make(map[types.FileContractID]bool),
+		budgetReserved:    make(map[*LedgerEntry]struct{}),
+		renewing:          make(map[types.FileContractID]bool),
+		subscribers:       make(map[*subscriber]struct{}),
+	}
+	for _, opt := range opts {
+		opt(srv)
 	}
 
-	// load host sets
-	hostSetsJSON, err := ioutil.ReadFile(filepath.Join(dir, "hostSets.json"))
-	if os.IsNotExist(err) {
-		srv.hostSets = make(map[string][]hostdb.HostPublicKey)
-	} else {
+	ownStore := srv.store == nil
+	if ownStore {
+		store, err := NewBoltStore(filepath.Join(dir, "muse.db"))
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(hostSetsJSON, &srv.hostSets); err != nil {
-			return nil, err
-		}
+		srv.store = store
 	}
-
-	// load all contracts
-	infos, err := ioutil.ReadDir(dir)
+	var imported []string
+	err := srv.store.Update(func(tx Tx) (err error) {
+		imported, err = srv.load(tx)
+		return err
+	})
 	if err != nil {
+		if ownStore {
+			srv.store.Close()
+		}
 		return nil, err
 	}
-	for _, info := range infos {
-		if filepath.Ext(info.Name()) != ".contract" {
-			continue
+	if err := cleanupLegacyStateFiles(dir, imported, srv.log); err != nil {
+		if ownStore {
+			srv.store.Close()
 		}
-		js, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
-		if err != nil {
-			return nil, err
-		}
-		var c Contract
-		if err := json.Unmarshal(js, &c); err != nil {
-			return nil, err
-		}
-		srv.contracts = append(srv.contracts, c)
+		return nil, err
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/contracts", srv.handleContracts)
 	mux.HandleFunc("/form", srv.handleForm)
 	mux.HandleFunc("/renew", srv.handleRenew)
+	mux.HandleFunc("/refresh", srv.handleRefresh)
 	mux.HandleFunc("/delete/", srv.handleDelete)
+	mux.HandleFunc("/restore/", srv.handleRestore)
+	mux.HandleFunc("/lineage/", srv.handleLineage)
+	mux.HandleFunc("/ledger", srv.handleLedger)
+	mux.HandleFunc("/hosts/", srv.handleHosts)
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+	mux.HandleFunc("/audit", srv.handleAudit)
+	mux.HandleFunc("/webhooks/", srv.handleWebhooks)
+	mux.HandleFunc("/events", srv.handleEvents)
 	mux.HandleFunc("/hostsets/", srv.handleHostSets)
 	mux.HandleFunc("/scan", srv.handleScan)
+	mux.HandleFunc("/tenants/", srv.handleTenants)
+	mux.HandleFunc("/hostrules/", srv.handleHostRules)
 
 	// shard proxy
 	shardURL, err := url.Parse(shardAddr)
@@ -427,6 +856,22 @@ func NewServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, sha
 		req.URL.Scheme = shardURL.Scheme
 		req.URL.Host = shardURL.Host
 		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/shard")
+		// don't leak API keys to shard
+		req.Header.Del("Authorization")
 	}})
-	return mux, nil
+	srv.mux = mux
+	return srv, nil
+}
+
+// NewServer returns an HTTP handler that serves the muse API.
+func NewServer(dir string, wallet proto.Wallet, tpool proto.TransactionPool, shardAddr string, opts ...ServerOption) (http.Handler, error) {
+	srv, err := newServer(dir, wallet, tpool, shardAddr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go srv.autoRenewLoop()
+	go srv.revisionLoop()
+	go srv.monitorLoop()
+	go srv.archiveLoop()
+	return srv, nil
 }
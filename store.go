@@ -0,0 +1,331 @@
+package muse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.sia.tech/siad/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// A Store persists server state as key-value pairs grouped into buckets.
+// Stores must be transactional: either all of the changes made within a
+// single Update call are durably persisted, or none of them are.
+type Store interface {
+	// View calls fn within a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update calls fn within a read-write transaction. If fn returns an
+	// error, the transaction is rolled back.
+	Update(fn func(Tx) error) error
+	// Close closes the Store.
+	Close() error
+}
+
+// A Tx is a transaction within a Store.
+type Tx interface {
+	// Get returns the value associated with key in the specified bucket, or
+	// nil if no such value exists. The returned slice remains valid after
+	// the transaction has ended.
+	Get(bucket string, key []byte) []byte
+	// Put associates a value with key in the specified bucket, creating the
+	// bucket if necessary.
+	Put(bucket string, key, value []byte) error
+	// Delete removes key from the specified bucket.
+	Delete(bucket string, key []byte) error
+	// ForEach calls fn on each key-value pair in the specified bucket, in
+	// ascending key order. The supplied slices are only valid until fn
+	// returns.
+	ForEach(bucket string, fn func(key, value []byte) error) error
+	// Seek calls fn on the key-value pairs in the specified bucket, starting
+	// at the first key greater than or equal to start and proceeding in
+	// ascending order, or, if reverse is true, starting at the last key less
+	// than or equal to start and proceeding in descending order. A nil start
+	// begins at the first (or last) key. Iteration stops when fn returns false
+	// or an error. The supplied slices are only valid until fn returns.
+	Seek(bucket string, start []byte, reverse bool, fn func(key, value []byte) (bool, error)) error
+}
+
+// WithStore causes the server to persist its state to the supplied Store,
+// rather than the default BoltDB database in the server's directory.
+func WithStore(store Store) ServerOption {
+	return func(s *server) {
+		s.store = store
+	}
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (tx boltTx) Get(bucket string, key []byte) []byte {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	if v := b.Get(key); v != nil {
+		return append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (tx boltTx) Put(bucket string, key, value []byte) error {
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (tx boltTx) Delete(bucket string, key []byte) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func (tx boltTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(fn)
+}
+
+func (tx boltTx) Seek(bucket string, start []byte, reverse bool, fn func(key, value []byte) (bool, error)) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	var k, v []byte
+	switch {
+	case start == nil && !reverse:
+		k, v = c.First()
+	case start == nil:
+		k, v = c.Last()
+	default:
+		k, v = c.Seek(start)
+		if reverse && k == nil {
+			k, v = c.Last()
+		} else if reverse && !bytes.Equal(k, start) {
+			k, v = c.Prev()
+		}
+	}
+	next := c.Next
+	if reverse {
+		next = c.Prev
+	}
+	for ; k != nil; k, v = next() {
+		if more, err := fn(k, v); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s boltStore) View(fn func(Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Update(fn func(Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (s boltStore) Close() error {
+	return s.db.Close()
+}
+
+// NewBoltStore returns a Store backed by the BoltDB database at the specified
+// path, creating it if it does not exist.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return boltStore{db}, nil
+}
+
+// bucket names
+const (
+	bucketMeta          = "meta"
+	bucketContracts     = "contracts"
+	bucketPending       = "pendingContracts"
+	bucketHostSets      = "hostSets"
+	bucketRenewPolicies = "renewPolicies"
+	bucketTenants       = "tenants"
+	bucketHostSetOwners = "hostSetOwners"
+	bucketBudgets       = "budgets"
+	bucketLedger        = "ledger"
+	bucketHosts         = "hosts"
+	bucketAudit         = "audit"
+	bucketArchive       = "archivedContracts"
+	bucketWebhooks      = "webhooks"
+	bucketPriceLimits   = "priceLimits"
+	bucketHostRules     = "hostRules"
+	bucketHealPolicies  = "healPolicies"
+)
+
+func putJSON(tx Tx, bucket string, key []byte, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, js)
+}
+
+// putSealedJSON stores v as JSON, encrypting it if the server has an
+// encryption key.
+func (s *server) putSealedJSON(tx Tx, bucket string, key []byte, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, s.seal(js))
+}
+
+func (s *server) putContract(tx Tx, c Contract) error {
+	return s.putSealedJSON(tx, bucketContracts, c.ID[:], c)
+}
+
+func (s *server) putArchivedContract(tx Tx, c Contract) error {
+	return s.putSealedJSON(tx, bucketArchive, c.ID[:], c)
+}
+
+// loadContracts loads the contracts in the specified bucket. If the server has
+// an encryption key, any plaintext contracts are encrypted using put.
+func (s *server) loadContracts(tx Tx, bucket string, put func(Tx, Contract) error) ([]Contract, error) {
+	var contracts, plaintext []Contract
+	err := tx.ForEach(bucket, func(key, value []byte) error {
+		js, encrypted, err := s.unseal(value)
+		if err != nil {
+			return fmt.Errorf("contract %x: %w", key, err)
+		}
+		var c Contract
+		if err := json.Unmarshal(js, &c); err != nil {
+			s.log.Warn("skipping corrupt contract", "contractID", fmt.Sprintf("%x", key), "err", err)
+			return nil
+		}
+		contracts = append(contracts, c)
+		if !encrypted {
+			plaintext = append(plaintext, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// if we have an encryption key, encrypt any plaintext contracts
+	if s.aead != nil && len(plaintext) > 0 {
+		for _, c := range plaintext {
+			if err := put(tx, c); err != nil {
+				return nil, err
+			}
+		}
+		s.log.Info("encrypted plaintext contracts", "count", len(plaintext))
+	}
+	return contracts, nil
+}
+
+// load initializes the server's state from the store. If the store has not
+// been initialized, any state stored in the legacy (pre-Store) format is
+// imported first, and the paths of the imported files are returned.
+func (s *server) load(tx Tx) (imported []string, err error) {
+	if tx.Get(bucketMeta, []byte("version")) == nil {
+		if imported, err = s.importLegacyState(tx); err != nil {
+			return nil, fmt.Errorf("could not import legacy state: %w", err)
+		}
+		if err := tx.Put(bucketMeta, []byte("version"), []byte{1}); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.contracts, err = s.loadContracts(tx, bucketContracts, s.putContract); err != nil {
+		return nil, err
+	} else if s.archive, err = s.loadContracts(tx, bucketArchive, s.putArchivedContract); err != nil {
+		return nil, err
+	}
+
+	var pending int
+	tx.ForEach(bucketPending, func(_, _ []byte) error {
+		pending++
+		return nil
+	})
+	if pending > 0 {
+		s.log.Warn("contract formations were interrupted; their renter keys are retained", "count", pending, "bucket", bucketPending)
+	}
+
+	s.hostSets = make(map[string][]hostdb.HostPublicKey)
+	s.renewPolicies = make(map[string]RenewPolicy)
+	s.hostSetOwners = make(map[string]string)
+	s.tenants = make(map[string]crypto.Hash)
+	s.budgets = make(map[string]Budget)
+	s.setPriceLimits = make(map[string]PriceLimits)
+	s.healPolicies = make(map[string]HealPolicy)
+	tx.ForEach(bucketHostSets, func(key, value []byte) error {
+		var hosts []hostdb.HostPublicKey
+		if err := json.Unmarshal(value, &hosts); err != nil {
+			s.log.Warn("skipping corrupt host set", "hostSet", string(key), "err", err)
+			return nil
+		}
+		s.hostSets[string(key)] = hosts
+		return nil
+	})
+	tx.ForEach(bucketRenewPolicies, func(key, value []byte) error {
+		var policy RenewPolicy
+		if err := json.Unmarshal(value, &policy); err != nil {
+			s.log.Warn("skipping corrupt renew policy", "hostSet", string(key), "err", err)
+			return nil
+		}
+		s.renewPolicies[string(key)] = policy
+		return nil
+	})
+	tx.ForEach(bucketBudgets, func(key, value []byte) error {
+		var budget Budget
+		if err := json.Unmarshal(value, &budget); err != nil {
+			s.log.Warn("skipping corrupt budget", "hostSet", string(key), "err", err)
+			return nil
+		}
+		s.budgets[string(key)] = budget
+		return nil
+	})
+	tx.ForEach(bucketPriceLimits, func(key, value []byte) error {
+		var limits PriceLimits
+		if err := json.Unmarshal(value, &limits); err != nil {
+			s.log.Warn("skipping corrupt price limits", "hostSet", string(key), "err", err)
+			return nil
+		}
+		s.setPriceLimits[string(key)] = limits
+		return nil
+	})
+	tx.ForEach(bucketHealPolicies, func(key, value []byte) error {
+		var policy HealPolicy
+		if err := json.Unmarshal(value, &policy); err != nil {
+			s.log.Warn("skipping corrupt heal policy", "hostSet", string(key), "err", err)
+			return nil
+		}
+		s.healPolicies[string(key)] = policy
+		return nil
+	})
+	tx.ForEach(bucketHostSetOwners, func(key, value []byte) error {
+		s.hostSetOwners[string(key)] = string(value)
+		return nil
+	})
+	tx.ForEach(bucketTenants, func(key, value []byte) error {
+		var h crypto.Hash
+		copy(h[:], value)
+		s.tenants[string(key)] = h
+		return nil
+	})
+	s.loadLedger(tx)
+	s.loadHosts(tx)
+	s.loadHostRules(tx)
+	return imported, s.loadWebhooks(tx)
+}
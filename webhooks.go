@@ -0,0 +1,329 @@
+package muse
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+const (
+	// webhookAttempts is the number of times the server attempts to deliver
+	// an event to a webhook before giving up.
+	webhookAttempts = 5
+
+	// maxWebhookDeliveries is the number of delivery attempts retained for
+	// each webhook.
+	maxWebhookDeliveries = 100
+)
+
+// webhookBackoff is the delay before the first retry of a failed delivery; it
+// doubles with each subsequent retry.
+var webhookBackoff = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// tenantWebhookClient delivers events to webhooks registered by tenants. It
+// refuses to connect to private addresses, even if the webhook's hostname has
+// come to resolve to one since it was registered.
+var tenantWebhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				} else if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+					return fmt.Errorf("refusing to connect to private address %v", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// privateNets are the loopback, link-local, and private (RFC 1918 and RFC
+// 4193) address ranges, which webhooks registered by tenants may not refer to.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// privateIP reports whether ip is in one of privateNets.
+func privateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookHost returns an error if host, a hostname or IP address, does
+// not resolve or resolves to a private address.
+func checkWebhookHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("Could not resolve webhook host: %w", err)
+	}
+	for _, ip := range ips {
+		if privateIP(ip) {
+			return errors.New("Webhook URL must not refer to a private address")
+		}
+	}
+	return nil
+}
+
+// WebhookSignature returns the signature of a webhook payload, as sent in the
+// X-Muse-Signature header. Receivers should compute the signature of the
+// request body using the webhook's secret and compare it to the header (with
+// hmac.Equal) before trusting the payload.
+func WebhookSignature(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// deliver POSTs body to the webhook, retrying with exponential backoff. It
+// gives up early if the webhook is deleted.
+func (s *server) deliver(h Webhook, ev Event, body []byte) {
+	log := s.log.With("webhook", h.ID, "event", ev.Type, "eventID", ev.ID)
+	delay := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		code, err := postWebhook(h, ev, body)
+		d := WebhookDelivery{
+			EventID:    ev.ID,
+			EventType:  ev.Type,
+			Time:       time.Now(),
+			Attempt:    attempt,
+			StatusCode: code,
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if !s.recordDelivery(h.ID, d) || err == nil {
+			return
+		} else if attempt == webhookAttempts {
+			log.Warn("giving up on webhook delivery", "attempts", attempt, "err", err)
+			return
+		}
+		log.Debug("webhook delivery failed; retrying", "attempt", attempt, "delay", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(h Webhook, ev Event, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Muse-Event", ev.Type)
+	req.Header.Set("X-Muse-Delivery", ev.ID)
+	req.Header.Set("X-Muse-Signature", WebhookSignature(h.Secret, body))
+	client := webhookClient
+	if h.Tenant != "" {
+		client = tenantWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordDelivery appends d to the webhook's delivery log. It returns false if
+// the webhook no longer exists.
+func (s *server) recordDelivery(id string, d WebhookDelivery) bool {
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	if _, ok := s.webhooks[id]; !ok {
+		return false
+	}
+	log := append(s.webhookDeliveries[id], d)
+	if len(log) > maxWebhookDeliveries {
+		log = append([]WebhookDelivery(nil), log[len(log)-maxWebhookDeliveries:]...)
+	}
+	s.webhookDeliveries[id] = log
+	return true
+}
+
+// loadWebhooks loads the server's webhooks from the store.
+func (s *server) loadWebhooks(tx Tx) error {
+	s.webhooks = make(map[string]Webhook)
+	s.webhookDeliveries = make(map[string][]WebhookDelivery)
+	return tx.ForEach(bucketWebhooks, func(key, value []byte) error {
+		js, _, err := s.unseal(value)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %w", key, err)
+		}
+		var h Webhook
+		if err := json.Unmarshal(js, &h); err != nil {
+			s.log.Warn("skipping corrupt webhook", "webhook", string(key), "err", err)
+			return nil
+		}
+		s.webhooks[h.ID] = h
+		return nil
+	})
+}
+
+// withoutSecret returns a copy of h with its secret removed.
+func (h Webhook) withoutSecret() Webhook {
+	h.Secret = ""
+	return h
+}
+
+func (s *server) handleWebhooks(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/webhooks/")
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		if id, sub := id[:i], id[i+1:]; sub == "deliveries" && req.Method == http.MethodGet {
+			s.eventMu.Lock()
+			h, ok := s.webhooks[id]
+			deliveries := append([]WebhookDelivery(nil), s.webhookDeliveries[id]...)
+			s.eventMu.Unlock()
+			if !ok || !canAccess(req, h.Tenant) {
+				writeErrorKind(w, "No record of that webhook", http.StatusBadRequest, ErrorKindNotFound)
+				return
+			}
+			writeJSON(w, deliveries)
+		} else {
+			writeError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.eventMu.Lock()
+		var hooks []Webhook
+		for _, h := range s.webhooks {
+			if canAccess(req, h.Tenant) && (id == "" || h.ID == id) {
+				hooks = append(hooks, h.withoutSecret())
+			}
+		}
+		s.eventMu.Unlock()
+		sort.Slice(hooks, func(i, j int) bool {
+			return hooks[i].ID < hooks[j].ID
+		})
+		if id == "" {
+			writeJSON(w, hooks)
+		} else if len(hooks) == 0 {
+			writeErrorKind(w, "No record of that webhook", http.StatusBadRequest, ErrorKindNotFound)
+		} else {
+			writeJSON(w, hooks[0])
+		}
+
+	case http.MethodPost:
+		if id != "" {
+			writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var h Webhook
+		if err := json.NewDecoder(req.Body).Decode(&h); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, "Invalid webhook URL", http.StatusBadRequest)
+			return
+		}
+		// only the admin may register webhooks on the server's own network
+		if requestTenant(req) != "" {
+			if err := checkWebhookHost(u.Hostname()); err != nil {
+				writeError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, typ := range h.Events {
+			if !validEventType(typ) {
+				writeError(w, fmt.Sprintf("Unknown event type %q", typ), http.StatusBadRequest)
+				return
+			}
+		}
+		h.ID = hex.EncodeToString(frand.Bytes(8))
+		h.Tenant = requestTenant(req)
+		if h.Secret == "" {
+			h.Secret = hex.EncodeToString(frand.Bytes(32))
+		}
+		ae := newAuditEntry(req, "webhook", h.ID, h.Tenant, "added webhook "+h.URL, nil, h.withoutSecret())
+		s.mu.Lock()
+		s.eventMu.Lock()
+		err = s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			return s.putSealedJSON(tx, bucketWebhooks, []byte(h.ID), h)
+		})
+		if err == nil {
+			s.webhooks[h.ID] = h
+		}
+		s.eventMu.Unlock()
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, h)
+
+	case http.MethodDelete:
+		s.mu.Lock()
+		s.eventMu.Lock()
+		h, ok := s.webhooks[id]
+		if !ok || !canAccess(req, h.Tenant) {
+			s.eventMu.Unlock()
+			s.mu.Unlock()
+			writeErrorKind(w, "No record of that webhook", http.StatusBadRequest, ErrorKindNotFound)
+			return
+		}
+		ae := newAuditEntry(req, "webhook", h.ID, h.Tenant, "deleted webhook "+h.URL, h.withoutSecret(), nil)
+		err := s.store.Update(func(tx Tx) error {
+			if err := s.putAudit(tx, ae); err != nil {
+				return err
+			}
+			return tx.Delete(bucketWebhooks, []byte(h.ID))
+		})
+		if err == nil {
+			delete(s.webhooks, h.ID)
+			delete(s.webhookDeliveries, h.ID)
+		}
+		s.eventMu.Unlock()
+		s.mu.Unlock()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		writeError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}